@@ -2,7 +2,7 @@ package src
 
 import (
 	"bytes"
-	"crypto/sha256"
+	"context"
     "encoding/gob"
     "time"
 )
@@ -11,26 +11,45 @@ type Block struct {
 	Timestamp     int64          // 当前时间戳，也就是区块创建的时间
 	Transcations  []*Transaction // 区块存储的实际有效信息，也就是交易
 	PrevBlockHash []byte         // 前一个块的哈希，即父哈希，256-bit，32 bytes
+	MerkleRoot    []byte         // 所有交易 ID 构成的默克尔树的根哈希，工作量证明通过它承诺块中的交易
 	Hash          []byte         // 当前块的哈希，256-bit，32 bytes
+	Bits          uint32         // 难度目标的压缩表示，见 CompactToBig
 	Nonce         int
-	Height        int
+	Height        int            // 块高度，创世块为 0
 }
 
-// 生成一个新的块
-func NewBlock(transactions []*Transaction, preBlockHash []byte) *Block {
+// 生成一个新的块，bits 是这个高度上要求的难度，见 BlockChain.NextBits
+func NewBlock(transactions []*Transaction, preBlockHash []byte, height int, bits uint32) *Block {
+	block, err := NewBlockContext(context.Background(), transactions, preBlockHash, height, bits)
+	if nil != err {
+		panic(err)
+	}
+
+	return block
+}
+
+// NewBlockContext is like NewBlock but stops mining and returns ctx.Err() once ctx is cancelled
+func NewBlockContext(ctx context.Context, transactions []*Transaction, preBlockHash []byte, height int,
+	bits uint32) (*Block, error) {
 	block := &Block{
 		Transcations:  transactions,
 		PrevBlockHash: preBlockHash,
 		Timestamp:     time.Now().Unix(),
+		Bits:          bits,
 		Nonce:         0,
+		Height:        height,
 	}
+	block.MerkleRoot = block.HashTranscations()
 	pow := NewProofOfWork(block)
-	nonce, hash := pow.Run()
+	nonce, hash, err := pow.Run(ctx)
+	if nil != err {
+		return nil, err
+	}
 
 	block.Hash = hash
 	block.Nonce = nonce
 
-	return block
+	return block, nil
 }
 
 /*// 计算块的Hash值
@@ -46,22 +65,19 @@ func (this *Block) SetHash() {
 
 // 创建 创世块（genesis block）
 func CreateGenesisBlock(coinBase *Transaction) *Block {
-	return NewBlock([]*Transaction{coinBase}, []byte{})
+	return NewBlock([]*Transaction{coinBase}, []byte{}, 0, ActiveChainParams().genesisBits())
 }
 
+// 以交易 ID 为叶子构造默克尔树，返回根哈希
 func (this *Block) HashTranscations() []byte {
-	var (
-		txHashes [][]byte
-		txHash   [32]byte
-	)
+	var txHashes [][]byte
 
 	for _, tx := range this.Transcations {
 		txHashes = append(txHashes, tx.ID) // 取得每笔交易的哈希
 	}
-    // Join函数的功能是用字节切片sep把s中的每个字节切片连成一个字节切片并返回.
-	txHash = sha256.Sum256(bytes.Join(txHashes, []byte{})) // 将它们组合之后计算哈希
+	mTree := NewMerkleTree(txHashes)
 
-	return txHash[:]
+	return mTree.RootNode.Data
 }
 
 func (this *Block) Serialize() []byte {
@@ -76,12 +92,22 @@ func (this *Block) Serialize() []byte {
 }
 
 func DeserializeBlock(data []byte) *Block {
+    block, err := decodeBlock(data)
+    if nil != err {
+        panic(err)
+    }
+
+    return block
+}
+
+// 解码其他节点发来的块，数据不对时返回错误而不是 panic
+func decodeBlock(data []byte) (*Block, error) {
     var block Block
 
     decoder := gob.NewDecoder(bytes.NewReader(data))
     if err := decoder.Decode(&block); nil != err {
-        panic(err)
+        return nil, err
     }
 
-    return &block
+    return &block, nil
 }
@@ -2,21 +2,26 @@ package src
 
 import (
     "bytes"
+    "context"
     "crypto/ecdsa"
     "encoding/hex"
     "errors"
     "fmt"
     "github.com/boltdb/bolt"
+    "math/big"
     "os"
+    "sync"
 )
 
-const dbFile = "blockchain_%s.db"
 const blocksBucket = "blocks"
-const genesisCoinBaseData = "The Times 03/Jan/2009 Chancellor on brink of second bailout for banks"
+const heightsBucket = "heights" // 主链上 高度 -> 块哈希 的索引
+const chainWorkBucket = "chainwork" // 块哈希 -> 从创世块到该块的累计工作量
 
 type BlockChain struct {
-    tip []byte
-    db  *bolt.DB
+    tip     []byte
+    tipLock sync.RWMutex // 收到块的协程和挖矿协程都会修改 tip
+    db      *bolt.DB
+    mempool *Mempool // 重组时撤销的交易放回这里，见 SetMempool
 }
 
 // 区块链迭代器
@@ -25,47 +30,220 @@ type BlockChainIterator struct {
     db          *bolt.DB
 }
 
-// 入链
-func (this *BlockChain) AddBlock(data string) {
-    var lastHash []byte
+// 入链，保存从其他节点收到的块。块可以接在任意已知的块后面，形成分叉；
+// 当某条分支的累计工作量超过当前主链时，自动重组到这条分支，并同步更新 UTXO 集
+// 校验失败时返回 *BlockError
+func (this *BlockChain) AddBlock(block *Block) error {
+    if err := checkBlock(block); nil != err {
+        return err
+    }
 
-    if err := this.db.View(func(tx *bolt.Tx) error {
-        b := tx.Bucket([]byte(blocksBucket))
-        lastHash = b.Get([]byte("l"))
+    return this.store(block)
+}
+
+// 在一个事务里保存块，提交成功之后才更新内存中的 tip，再把重组撤销的交易放回内存池
+func (this *BlockChain) store(block *Block) error {
+    var (
+        disconnected []*Block
+        tip          []byte
+    )
+    err := this.db.Update(func(tx *bolt.Tx) error {
+        var err error
+        if disconnected, err = this.storeBlock(tx, block); nil != err {
+            return err
+        }
+        tip = append([]byte{}, tx.Bucket([]byte(blocksBucket)).Get([]byte("l"))...)
 
         return nil
-    }); nil != err {
-        panic(err)
+    })
+    if nil != err {
+        return err
     }
+    this.setTipHash(tip)
+    this.resurrect(disconnected)
 
-    newBlock := NewBlock([]*Transaction{}, lastHash)
+    return nil
+}
 
-    if err := this.db.Update(func(tx *bolt.Tx) error {
-        b := tx.Bucket([]byte(blocksBucket))
-        if err := b.Put(newBlock.Hash, newBlock.Serialize()); nil != err {
-            panic(err)
+// 保存块并记录它的累计工作量，工作量超过当前 tip 时切换主链，返回从主链上撤下来的块。
+// 出错时整个事务回滚，块也不会保存
+func (this *BlockChain) storeBlock(tx *bolt.Tx, block *Block) ([]*Block, error) {
+    b := tx.Bucket([]byte(blocksBucket))
+    if b.Get(block.Hash) != nil {
+        return nil, nil // 已经有这个块了
+    }
+    if err := checkBlockHeader(tx, block); nil != err {
+        return nil, err
+    }
+
+    if err := b.Put(block.Hash, block.Serialize()); nil != err {
+        return nil, err
+    }
+    work := new(big.Int).Add(chainWork(tx, block.PrevBlockHash), NewProofOfWork(block).Work())
+    if err := putChainWork(tx, block.Hash, work); nil != err {
+        return nil, err
+    }
+
+    tipHash := b.Get([]byte("l"))
+    if work.Cmp(chainWork(tx, tipHash)) <= 0 {
+        return nil, nil // 侧链，先存着
+    }
+
+    return reorganize(tx, tipHash, block)
+}
+
+// SetMempool makes reorganizations put the transactions of the blocks leaving the main chain back into pool
+func (this *BlockChain) SetMempool(pool *Mempool) {
+    this.mempool = pool
+}
+
+// 撤下来的块里的交易按原来的顺序重新入池，新分支已经包含或与之冲突的交易会被 Mempool.Add 拒绝。
+// 内存池只接受花 UTXO 集里输出的交易，花了同一批被撤销交易输出的交易也会被拒绝
+func (this *BlockChain) resurrect(disconnected []*Block) {
+    if this.mempool == nil {
+        return
+    }
+
+    set := UTXOSet{this}
+    for i := len(disconnected) - 1; i >= 0; i-- {
+        for _, tx := range disconnected[i].Transcations {
+            if tx.IsCoinBase() {
+                continue
+            }
+            if err := this.mempool.Add(tx, &set); nil == err {
+                fmt.Printf("Transaction %x is back in the mempool\n", tx.ID)
+            }
+        }
+    }
+}
+
+// Close closes the database of the chain
+func (this *BlockChain) Close() error {
+    return this.db.Close()
+}
+
+func (this *BlockChain) tipHash() []byte {
+    this.tipLock.RLock()
+    defer this.tipLock.RUnlock()
+
+    return this.tip
+}
+
+func (this *BlockChain) setTipHash(hash []byte) {
+    this.tipLock.Lock()
+    defer this.tipLock.Unlock()
+
+    this.tip = append([]byte{}, hash...)
+}
+
+// 把主链切换到以 newTip 结尾的分支：先从旧 tip 往回撤销到分叉点，再从分叉点往后依次校验并连接新分支上的块。
+// 新块直接接在旧 tip 后面时，就只是连接这一个块。返回撤销的块，从旧 tip 开始
+func reorganize(tx *bolt.Tx, oldTipHash []byte, newTip *Block) ([]*Block, error) {
+    b := tx.Bucket([]byte(blocksBucket))
+    parent := func(block *Block) *Block {
+        return DeserializeBlock(b.Get(block.PrevBlockHash))
+    }
+
+    var connect, disconnect []*Block
+    oldBlock := DeserializeBlock(b.Get(oldTipHash))
+    newBlock := newTip
+    oldTipHeight := oldBlock.Height
+
+    for newBlock.Height > oldBlock.Height {
+        connect = append([]*Block{newBlock}, connect...)
+        newBlock = parent(newBlock)
+    }
+    for !bytes.Equal(oldBlock.Hash, newBlock.Hash) {
+        if err := disconnectBlockUTXO(tx, oldBlock); nil != err {
+            return nil, err
         }
-        if err := b.Put([]byte("l"), newBlock.Hash); nil != err {
-            panic(err)
+        disconnect = append(disconnect, oldBlock)
+        if oldBlock.Height == newBlock.Height {
+            connect = append([]*Block{newBlock}, connect...)
+            newBlock = parent(newBlock)
         }
-        this.tip = newBlock.Hash
+        oldBlock = parent(oldBlock)
+    }
+    if len(connect) > 1 || oldTipHeight >= newTip.Height {
+        fmt.Printf("Reorganize: fork at height %d, disconnect %d blocks, connect %d blocks\n",
+            oldBlock.Height, oldTipHeight-oldBlock.Height, len(connect))
+    }
 
-        return nil
-    }); nil != err {
-        panic(err)
+    heights := tx.Bucket([]byte(heightsBucket))
+    for height := newTip.Height + 1; height <= oldTipHeight; height++ {
+        if err := heights.Delete(IntToHex(int64(height))); nil != err {
+            return nil, err
+        }
+    }
+    for _, block := range connect {
+        if err := checkBlockTransactions(tx, block); nil != err {
+            return nil, err
+        }
+        if err := connectBlockUTXO(tx, block); nil != err {
+            return nil, err
+        }
+        if err := setTip(tx, block); nil != err {
+            return nil, err
+        }
+    }
+
+    return disconnect, nil
+}
+
+// 返回以 blockHash 结尾的链的累计工作量。旧数据库没有记录时，往回找到有记录的块再累加
+func chainWork(tx *bolt.Tx, blockHash []byte) *big.Int {
+    b := tx.Bucket([]byte(blocksBucket))
+    works := tx.Bucket([]byte(chainWorkBucket))
+    work := new(big.Int)
+
+    for len(blockHash) > 0 {
+        if works != nil {
+            if data := works.Get(blockHash); data != nil {
+                return work.Add(work, new(big.Int).SetBytes(data))
+            }
+        }
+        block := DeserializeBlock(b.Get(blockHash))
+        work.Add(work, NewProofOfWork(block).Work())
+        blockHash = block.PrevBlockHash
+    }
+
+    return work
+}
+
+func putChainWork(tx *bolt.Tx, blockHash []byte, work *big.Int) error {
+    works, err := tx.CreateBucketIfNotExists([]byte(chainWorkBucket))
+    if nil != err {
+        return err
+    }
+
+    return works.Put(blockHash, work.Bytes())
+}
+
+// 把块设为主链的 tip，并记录它的高度索引
+func setTip(tx *bolt.Tx, block *Block) error {
+    b := tx.Bucket([]byte(blocksBucket))
+    if err := b.Put([]byte("l"), block.Hash); nil != err {
+        return err
+    }
+
+    heights, err := tx.CreateBucketIfNotExists([]byte(heightsBucket))
+    if nil != err {
+        return err
     }
+
+    return heights.Put(IntToHex(int64(block.Height)), block.Hash)
 }
 
 // creates a new blockchain DB
 func CreateBlockChain(address, nodeID string) *BlockChain {
-    dbFile := fmt.Sprintf(dbFile, nodeID)
+    dbFile := fmt.Sprintf(ActiveChainParams().DBFile, nodeID)
     if dbExists(dbFile) {
         fmt.Println("BlockChain already exists.")
         os.Exit(1)
     }
 
     var tip []byte
-    cbtx := CreateCoinBaseTX(address, genesisCoinBaseData)
+    cbtx := CreateCoinBaseTX(address, ActiveChainParams().GenesisCoinBaseData, 0)
     genesis := CreateGenesisBlock(cbtx)
 
     db, err := bolt.Open(dbFile, 0600, nil)
@@ -85,27 +263,31 @@ func CreateBlockChain(address, nodeID string) *BlockChain {
             if nil != err {
                 panic(err)
             }
-            err = b.Put([]byte("l"), genesis.Hash)
+            err = setTip(tx, genesis)
+            if nil != err {
+                panic(err)
+            }
+            err = putChainWork(tx, genesis.Hash, NewProofOfWork(genesis).Work())
             if nil != err {
                 panic(err)
             }
 
             tip = genesis.Hash
         } else {
-            tip = b.Get([]byte("l"))
+            tip = append([]byte{}, b.Get([]byte("l"))...) // b.Get 返回的切片只在事务内有效
         }
 
         return nil
     })
 
-    bc := BlockChain{tip, db}
+    bc := BlockChain{tip: tip, db: db}
 
     return &bc
 }
 
 // 创建区块链，即有创世块的链， creates a new Blockchain with genesis Block
 func NewBlockChain(nodeID string) *BlockChain {
-    dbFile := fmt.Sprintf(dbFile, nodeID)
+    dbFile := fmt.Sprintf(ActiveChainParams().DBFile, nodeID)
     if dbExists(dbFile) == false {
         fmt.Println("No existing block chain found. Create one first.")
         os.Exit(1)
@@ -119,7 +301,11 @@ func NewBlockChain(nodeID string) *BlockChain {
 
     err = db.Update(func(tx *bolt.Tx) error {
         b := tx.Bucket([]byte(blocksBucket))
-        tip = b.Get([]byte("l"))
+        tip = append([]byte{}, b.Get([]byte("l"))...)
+
+        if tx.Bucket([]byte(heightsBucket)) == nil {
+            return indexHeights(tx, tip) // 旧版本的数据库没有高度索引，补建一份
+        }
 
         return nil
     })
@@ -127,89 +313,38 @@ func NewBlockChain(nodeID string) *BlockChain {
         panic(err)
     }
 
-    bc := BlockChain{tip, db}
+    bc := BlockChain{tip: tip, db: db}
 
     return &bc
 }
 
-// 找到所有的未花费输出
-func (this *BlockChain) FindSpendableOutputs(address string, amount int) (int, map[string][]int) {
-    var (
-        accumulated    = 0 // 累加货币值
-        unSpentOutputs = make(map[string][]int)
-        unSpentTXs     = this.FindUnSpentTransaction(address)
-    )
-
-Work:
-    for _, tx := range unSpentTXs {
-        txID := hex.EncodeToString(tx.ID)
-
-        for outIdx, out := range tx.Vout {
-            if out.CanBeUnlockedWith(address) && accumulated < amount {
-                accumulated += out.Value
-                unSpentOutputs[txID] = append(unSpentOutputs[txID], outIdx)
-
-                if accumulated >= amount {
-                    break Work
-                }
-            }
-        }
+// 从 tip 往回遍历主链，重建高度索引
+func indexHeights(tx *bolt.Tx, tip []byte) error {
+    b := tx.Bucket([]byte(blocksBucket))
+    heights, err := tx.CreateBucketIfNotExists([]byte(heightsBucket))
+    if nil != err {
+        return err
     }
 
-    return accumulated, unSpentOutputs
-}
-
-// 找到包含未花费输出的交易
-func (this *BlockChain) FindUnSpentTransaction(address string) []Transaction {
-    var (
-        unSpentTXs []Transaction
-        spentTXOs  = make(map[string][]int)
-        bci        = this.Iterator()
-    )
-
-    for {
-        block := bci.Next()
-
-        for _, tx := range block.Transcations {
-            txID := hex.EncodeToString(tx.ID)
-
-        Outputs:
-            for outIdx, out := range tx.Vout {
-                // Was the output spent?
-                if spentTXOs[txID] != nil {
-                    for _, spentOut := range spentTXOs[txID] {
-                        if spentOut == outIdx {
-                            continue Outputs
-                        }
-                    }
-                }
-
-                if out.CanBeUnlockedWith(address) {
-                    unSpentTXs = append(unSpentTXs, *tx)
-                }
-            }
-
-            if tx.IsCoinBase() == false {
-                for _, in := range tx.Vin {
-                    if in.CanUnlockOutputWith(address) {
-                        inTxID := hex.EncodeToString(in.Txid)
-                        spentTXOs[inTxID] = append(spentTXOs[inTxID], in.Vout)
-                    }
-                }
-            }
-
-            if len(block.PrevBlockHash) == 0 { // 到链尾了，轮询结束
-                break
-            }
+    // 旧数据库里的块没有记录高度，先数出链长，再从 tip 往回依次编号
+    count := 0
+    for hash := tip; len(hash) > 0; hash = DeserializeBlock(b.Get(hash)).PrevBlockHash {
+        count++
+    }
+    height := count - 1
+    for hash := tip; len(hash) > 0; hash = DeserializeBlock(b.Get(hash)).PrevBlockHash {
+        if err := heights.Put(IntToHex(int64(height)), hash); nil != err {
+            return err
         }
+        height--
     }
 
-    return unSpentTXs
+    return nil
 }
 
 func (this *BlockChain) Iterator() *BlockChainIterator {
     return &BlockChainIterator{
-        currentHash: this.tip,
+        currentHash: this.tipHash(),
         db:          this.db,
     }
 }
@@ -232,101 +367,166 @@ func (this *BlockChainIterator) Next() *Block {
     return block
 }
 
-// MineBlock mines a new block with the provided transactions
-func (this *BlockChain) MineBlock(transactions []*Transaction) *Block {
-    var (
-    	lastHash []byte
-    )
-
-    for _, tx := range transactions {
-        // TODO: ignore transaction if it's not valid
-        if this.VerifyTransaction(tx) != true {
-            panic("ERROR: Invalid transaction")
-        }
-    }
+// HasBlock reports whether the block with the given hash is stored
+func (this *BlockChain) HasBlock(blockHash []byte) bool {
+    found := false
 
-    err := this.db.View(func(tx *bolt.Tx) error {
+    if err := this.db.View(func(tx *bolt.Tx) error {
         b := tx.Bucket([]byte(blocksBucket))
-        lastHash = b.Get([]byte("l"))
+        found = b.Get(blockHash) != nil
+
         return nil
-    })
-    if err != nil {
+    }); nil != err {
         panic(err)
     }
 
-    newBlock := NewBlock(transactions, lastHash)
+    return found
+}
+
+// GetBlock finds a block by its hash and returns it
+func (this *BlockChain) GetBlock(blockHash []byte) (Block, error) {
+    var block Block
 
-    err = this.db.Update(func(tx *bolt.Tx) error {
+    err := this.db.View(func(tx *bolt.Tx) error {
         b := tx.Bucket([]byte(blocksBucket))
-        err := b.Put(newBlock.Hash, newBlock.Serialize())
-        if err != nil {
-            panic(err)
+        blockData := b.Get(blockHash)
+        if blockData == nil {
+            return fmt.Errorf("block %x is not found", blockHash)
         }
+        block = *DeserializeBlock(blockData)
+
+        return nil
+    })
+
+    return block, err
+}
+
+// NextBits returns the difficulty required for a block mined on top of the given block
+func (this *BlockChain) NextBits(prevBlockHash []byte) (uint32, error) {
+    var bits uint32
 
-        err = b.Put([]byte("l"), newBlock.Hash)
-        if err != nil {
-            panic(err)
+    err := this.db.View(func(tx *bolt.Tx) error {
+        prevBlockData := tx.Bucket([]byte(blocksBucket)).Get(prevBlockHash)
+        if prevBlockData == nil {
+            return fmt.Errorf("block %x is not found", prevBlockHash)
         }
+        bits = nextBits(tx, DeserializeBlock(prevBlockData))
+
+        return nil
+    })
 
-        this.tip = newBlock.Hash
+    return bits, err
+}
+
+// GetBlockByHeight returns the main chain block at the given height
+func (this *BlockChain) GetBlockByHeight(height int) (Block, error) {
+    var block Block
+
+    err := this.db.View(func(tx *bolt.Tx) error {
+        blockHash := tx.Bucket([]byte(heightsBucket)).Get(IntToHex(int64(height)))
+        if blockHash == nil {
+            return fmt.Errorf("no block at height %d", height)
+        }
+        block = *DeserializeBlock(tx.Bucket([]byte(blocksBucket)).Get(blockHash))
 
         return nil
     })
+
+    return block, err
+}
+
+// GetBlockHashes returns hashes of main chain blocks with heights in [from, to], from low to high.
+// Heights above the tip are ignored
+func (this *BlockChain) GetBlockHashes(from, to int) [][]byte {
+    var blocks [][]byte
+
+    if from < 0 {
+        from = 0
+    }
+
+    if err := this.db.View(func(tx *bolt.Tx) error {
+        heights := tx.Bucket([]byte(heightsBucket))
+        bestHeight := DeserializeBlock(tx.Bucket([]byte(blocksBucket)).Get(this.tipHash())).Height
+        if to > bestHeight {
+            to = bestHeight
+        }
+
+        for height := from; height <= to; height++ {
+            blockHash := heights.Get(IntToHex(int64(height)))
+            blocks = append(blocks, append([]byte{}, blockHash...))
+        }
+
+        return nil
+    }); nil != err {
+        panic(err)
+    }
+
+    return blocks
+}
+
+// MineBlock mines a new block with the provided transactions on top of the tip.
+// The UTXO set is updated when the block is connected
+func (this *BlockChain) MineBlock(transactions []*Transaction) *Block {
+    newBlock, err := this.mineBlock(context.Background(), func(int) []*Transaction { return transactions })
     if err != nil {
         panic(err)
     }
 
     return newBlock
+}
 
-    /*
-    var lastHash []byte
-    var lastHeight int
+// MineBlockContext mines transactions on top of the tip, after a coinbase paying minerAddress the subsidy of the
+// new block's height plus fees. It returns an error instead of panicking, and ctx.Err() once ctx is cancelled
+func (this *BlockChain) MineBlockContext(ctx context.Context, minerAddress string, fees int,
+    transactions []*Transaction) (*Block, error) {
+    return this.mineBlock(ctx, func(height int) []*Transaction {
+        return append([]*Transaction{CreateCoinBaseTXWithFees(minerAddress, "", height, fees)}, transactions...)
+    })
+}
 
-    for _, tx := range transactions {
-        // TODO: ignore transaction if it's not valid
-        if this.VerifyTransaction(tx) != true {
-            panic("ERROR: Invalid transaction")
-        }
-    }
+// 读出 tip 之后再由 transactions 按新块的高度生成块中的交易，coinbase 的高度和奖励与块所在的位置一致
+func (this *BlockChain) mineBlock(ctx context.Context, transactions func(height int) []*Transaction) (*Block, error) {
+    var (
+        lastHash   []byte
+        lastHeight int
+        bits       uint32
+    )
 
     err := this.db.View(func(tx *bolt.Tx) error {
         b := tx.Bucket([]byte(blocksBucket))
-        lastHash = b.Get([]byte("l"))
+        lastHash = append([]byte{}, b.Get([]byte("l"))...)
 
         blockData := b.Get(lastHash)
-        block := DeSerialize(blockData)
+        block := DeserializeBlock(blockData)
 
         lastHeight = block.Height
+        bits = nextBits(tx, block)
 
         return nil
     })
     if err != nil {
-        panic(err)
+        return nil, err
     }
 
-    newBlock := NewBlock(transactions, lastHash, lastHeight+1)
-
-    err = this.db.Update(func(tx *bolt.Tx) error {
-        b := tx.Bucket([]byte(blocksBucket))
-        err := b.Put(newBlock.Hash, newBlock.Serialize())
-        if err != nil {
-            panic(err)
-        }
-
-        err = b.Put([]byte("l"), newBlock.Hash)
-        if err != nil {
-            panic(err)
+    txs := transactions(lastHeight + 1)
+    for _, tx := range txs {
+        // TODO: ignore transaction if it's not valid
+        if this.VerifyTransaction(tx) != true {
+            return nil, errors.New("ERROR: Invalid transaction")
         }
+    }
 
-        this.tip = newBlock.Hash
-
-        return nil
-    })
+    newBlock, err := NewBlockContext(ctx, txs, lastHash, lastHeight+1, bits)
     if err != nil {
-        panic(err)
+        return nil, err
+    }
+
+    // 和收到的块走同一条入链流程：挖矿期间 tip 变了的话，新块只会成为侧链
+    if err = this.store(newBlock); err != nil {
+        return nil, err
     }
 
-    return newBlock*/
+    return newBlock, nil
 }
 
 // VerifyTransaction verifies transaction input signatures
@@ -335,17 +535,28 @@ func (this *BlockChain) VerifyTransaction(tx *Transaction) bool {
         return true
     }
 
+    // 输入引用的交易找不到，可能是对方乱发的，也可能是重组撤掉了前序交易，都算校验不通过
+    prevTXs, err := this.prevTransactions(tx)
+    if nil != err {
+        return false
+    }
+
+    return tx.Verify(prevTXs)
+}
+
+// 交易的输入所引用的交易
+func (this *BlockChain) prevTransactions(tx *Transaction) (map[string]Transaction, error) {
     prevTXs := make(map[string]Transaction)
 
     for _, vin := range tx.Vin {
         prevTX, err := this.FindTransaction(vin.Txid)
         if nil != err {
-            panic(err)
+            return nil, err
         }
         prevTXs[hex.EncodeToString(prevTX.ID)] = prevTX
     }
 
-    return tx.Verify(prevTXs)
+    return prevTXs, nil
 }
 
 func (this *BlockChain) FindTransaction(ID []byte) (Transaction, error) {
@@ -369,48 +580,95 @@ func (this *BlockChain) FindTransaction(ID []byte) (Transaction, error) {
     return Transaction{}, errors.New("Transaction is not found")
 }
 
-// SignTransaction signs inputs of a Transaction
-func (this *BlockChain) SignTransaction(tx *Transaction, privKey ecdsa.PrivateKey) {
-    prevTXs := make(map[string]Transaction)
+// UsedPubKeyHashes returns the public key hashes, hex encoded, that P2PKH outputs of the main chain are locked to.
+// 恢复钱包时据此判断哪些地址用过
+func (this *BlockChain) UsedPubKeyHashes() map[string]bool {
+    used := make(map[string]bool)
+    bci := this.Iterator()
 
-    for _, vin := range tx.Vin {
-        prevTX, err := this.FindTransaction(vin.Txid)
-        if err != nil {
-            panic(err)
+    for {
+        block := bci.Next()
+
+        for _, tx := range block.Transcations {
+            for _, out := range tx.Vout {
+                if pubKeyHash := out.ScriptPubKey.PubKeyHash(); pubKeyHash != nil {
+                    used[hex.EncodeToString(pubKeyHash)] = true
+                }
+            }
+        }
+
+        if len(block.PrevBlockHash) == 0 {
+            break
         }
-        prevTXs[hex.EncodeToString(prevTX.ID)] = prevTX
     }
 
-    tx.Sign(privKey, prevTXs)
+    return used
 }
 
-// finds all unspent transaction outputs and returns transactions with spent outputs removed
-func (this *BlockChain) FindUTXO() map[string]TXOutputs {
-    utxo := make(map[string]TXOutputs)
-    spentTXOs := make(map[string][]int)
+// FindNullData finds the earliest main chain transaction with an OP_RETURN output carrying data, and its block
+func (this *BlockChain) FindNullData(data []byte) (Transaction, Block, error) {
+    var (
+        found      *Transaction
+        foundBlock *Block
+    )
     bci := this.Iterator()
 
+    // 从链头往回找，最后找到的就是最早的那笔。同一个块里取排在最前面的那笔
     for {
         block := bci.Next()
 
+    Transactions:
         for _, tx := range block.Transcations {
-            txID := hex.EncodeToString(tx.ID)
-
-            Outputs:
-                for outIdx, out := range tx.Vout {
-                    // Was the output spent?
-                    if spentTXOs[txID] != nil {
-                        for _, spentOutIdx := range spentTXOs[txID] {
-                            if spentOutIdx == outIdx {
-                                continue Outputs
-                            }
-                        }
-                    }
-
-                    outs := utxo[txID]
-                    outs.Outputs = append(outs.Outputs, out)
-                    utxo[txID] = outs
+            for _, out := range tx.Vout {
+                if nullData, ok := out.ScriptPubKey.NullData(); ok && bytes.Equal(nullData, data) {
+                    found, foundBlock = tx, block
+                    break Transactions
+                }
+            }
+        }
+
+        if len(block.PrevBlockHash) == 0 {
+            break
+        }
+    }
+
+    if found == nil {
+        return Transaction{}, Block{}, errors.New("Data is not found")
+    }
+
+    return *found, *foundBlock, nil
+}
+
+// 交易被打包进某个块的证明，不需要块中的其他交易就能验证
+type TxProof struct {
+    BlockHash  []byte
+    Height     int
+    MerkleRoot []byte
+    Path       []MerkleProofNode
+}
+
+// GetTxProof finds the main chain block containing the transaction and builds its Merkle inclusion proof.
+// Verify it with VerifyMerkleProof(txid, proof.Path, proof.MerkleRoot)
+func (this *BlockChain) GetTxProof(txid []byte) (TxProof, error) {
+    bci := this.Iterator()
+
+    for {
+        block := bci.Next()
+
+        for index, tx := range block.Transcations {
+            if bytes.Equal(tx.ID, txid) {
+                var txHashes [][]byte
+                for _, tx := range block.Transcations {
+                    txHashes = append(txHashes, tx.ID)
+                }
+
+                path, err := NewMerkleTree(txHashes).Proof(index)
+                if nil != err {
+                    return TxProof{}, err
                 }
+
+                return TxProof{block.Hash, block.Height, block.MerkleRoot, path}, nil
+            }
         }
 
         if len(block.PrevBlockHash) == 0 {
@@ -418,7 +676,26 @@ func (this *BlockChain) FindUTXO() map[string]TXOutputs {
         }
     }
 
-    return utxo
+    return TxProof{}, errors.New("Transaction is not found")
+}
+
+// SignTransaction signs inputs of a Transaction
+func (this *BlockChain) SignTransaction(tx *Transaction, privKey ecdsa.PrivateKey) {
+    prevTXs, err := this.prevTransactions(tx)
+    if nil != err {
+        panic(err)
+    }
+    tx.Sign(privKey, prevTXs)
+}
+
+// SignMultiSigTransaction adds the signature of privKey to the multisig inputs of tx
+func (this *BlockChain) SignMultiSigTransaction(tx *Transaction, privKey ecdsa.PrivateKey) int {
+    prevTXs, err := this.prevTransactions(tx)
+    if nil != err {
+        panic(err)
+    }
+
+    return tx.SignMultiSig(privKey, prevTXs)
 }
 
 // returns the height of the latest block
@@ -0,0 +1,189 @@
+// @Title 网络参数
+// @Description 每个网络（主网、测试网、回归测试网）各自的地址前缀、奖励、难度、创世块和文件名
+package src
+
+import (
+	"fmt"
+	"math/big"
+	"strings"
+)
+
+// 一个网络的全部参数，不同网络的数据文件、地址和节点互不相通
+type ChainParams struct {
+	Name                string
+	AddressVersion      byte     // 地址的版本字节，决定地址的首字符
+	ScriptHashVersion   byte     // 脚本哈希（P2SH）地址的版本字节
+	PrivateKeyVersion   byte     // WIF 格式私钥的版本字节
+	HDCoinType          uint32   // HD 钱包派生路径 m/44'/coin'/0'/0/i 中的币种，测试用的网络都是 1
+	Subsidy             int      // 挖出新块的初始奖励金
+	HalvingInterval     int      // 每隔多少个块奖励金减半
+	MaxSupply           int      // 币的总量上限，发行到这个数就不再有奖励金
+	CoinbaseMaturity    int      // coinbase 的输出要过多少个块才能花
+	TargetBits          int      // 创世块的难度：hash开头必须有多少个0（以二进制来计算的）
+	PowLimitBits        int      // 难度下限：无论怎么调整，hash开头至少要有多少个0
+	RetargetInterval    int      // 每隔多少个块调整一次难度
+	TargetBlockSpacing  int64    // 期望的出块间隔，单位秒
+	NoRetargeting       bool     // 难度固定不变
+	GenesisCoinBaseData string   // 创世块 coinbase 中的文字，不同网络的创世块因此不同
+	DBFile              string   // 区块链数据库文件名，%s 是 NODE_ID
+	WalletFile          string   // 钱包文件名，%s 是 NODE_ID
+	SeedNodes           []string // 启动时认识的节点，第一个是中心节点
+}
+
+var (
+	// 类似比特币主网，开发环境长期运行的链
+	MainNetParams = ChainParams{
+		Name:                "mainnet",
+		AddressVersion:      0x00,
+		ScriptHashVersion:   0x05,
+		PrivateKeyVersion:   0x80,
+		HDCoinType:          0,
+		Subsidy:             10,
+		HalvingInterval:     210000,
+		MaxSupply:           4200000,
+		CoinbaseMaturity:    100,
+		TargetBits:          24,
+		PowLimitBits:        8,
+		RetargetInterval:    10,
+		TargetBlockSpacing:  10,
+		GenesisCoinBaseData: "The Times 03/Jan/2009 Chancellor on brink of second bailout for banks",
+		DBFile:              "blockchain_%s.db",
+		WalletFile:          "wallet_%s.dat",
+		SeedNodes:           []string{"localhost:3000"},
+	}
+
+	// 测试网，难度低一些，地址以 m 或 n 开头，脚本哈希地址以 2 开头
+	TestNetParams = ChainParams{
+		Name:                "testnet",
+		AddressVersion:      0x6f,
+		ScriptHashVersion:   0xc4,
+		PrivateKeyVersion:   0xef,
+		HDCoinType:          1,
+		Subsidy:             10,
+		HalvingInterval:     210000,
+		MaxSupply:           4200000,
+		CoinbaseMaturity:    100,
+		TargetBits:          16,
+		PowLimitBits:        4,
+		RetargetInterval:    10,
+		TargetBlockSpacing:  5,
+		GenesisCoinBaseData: "bitcoin_go testnet genesis",
+		DBFile:              "blockchain_testnet_%s.db",
+		WalletFile:          "wallet_testnet_%s.dat",
+		SeedNodes:           []string{"localhost:13000"},
+	}
+
+	// 回归测试网，难度极低且固定，挖矿几乎不花时间，地址以 R 开头
+	RegTestParams = ChainParams{
+		Name:                "regtest",
+		AddressVersion:      0x3c,
+		ScriptHashVersion:   0x7a,
+		PrivateKeyVersion:   0xef,
+		HDCoinType:          1,
+		Subsidy:             10,
+		HalvingInterval:     150,
+		MaxSupply:           4200000,
+		CoinbaseMaturity:    1,
+		TargetBits:          1,
+		PowLimitBits:        1,
+		RetargetInterval:    10,
+		TargetBlockSpacing:  1,
+		NoRetargeting:       true,
+		GenesisCoinBaseData: "bitcoin_go regtest genesis",
+		DBFile:              "blockchain_regtest_%s.db",
+		WalletFile:          "wallet_regtest_%s.dat",
+		SeedNodes:           []string{"localhost:23000"},
+	}
+)
+
+var activeParams = &MainNetParams // 当前使用的网络
+
+// ChainParamsByName returns the parameters of the network named mainnet, testnet or regtest
+func ChainParamsByName(name string) (*ChainParams, error) {
+	for _, params := range []*ChainParams{&MainNetParams, &TestNetParams, &RegTestParams} {
+		if strings.EqualFold(params.Name, name) {
+			return params, nil
+		}
+	}
+
+	return nil, fmt.Errorf("unknown network %q", name)
+}
+
+// ActiveChainParams returns the parameters of the network in use
+func ActiveChainParams() *ChainParams {
+	return activeParams
+}
+
+// SetChainParams switches to another network. Call it before opening block chains or wallets
+func SetChainParams(params *ChainParams) {
+	activeParams = params
+
+	knownNodesLock.Lock()
+	knownNodes = append([]string{}, params.SeedNodes...)
+	knownNodesLock.Unlock()
+}
+
+// Override sets a parameter chosen when the node starts instead of the preset value of the network:
+// maturity 是 CoinbaseMaturity，halving 是 HalvingInterval，max_supply 是 MaxSupply。同一个网络的节点要用相同的值，否则互相不认对方的块
+func (this *ChainParams) Override(option string, value int) error {
+	switch option {
+	case "maturity":
+		if value < 0 {
+			return fmt.Errorf("coinbase maturity %d is negative", value)
+		}
+		this.CoinbaseMaturity = value
+	case "halving":
+		if value <= 0 {
+			return fmt.Errorf("halving interval %d is not positive", value)
+		}
+		this.HalvingInterval = value
+	case "max_supply":
+		if value <= 0 {
+			return fmt.Errorf("max supply %d is not positive", value)
+		}
+		this.MaxSupply = value
+	default:
+		return fmt.Errorf("unknown chain parameter %q", option)
+	}
+
+	return nil
+}
+
+// BlockSubsidy returns the reward for mining the block at the given height
+func (this *ChainParams) BlockSubsidy(height int) int {
+	return this.Supply(height) - this.Supply(height-1)
+}
+
+// Supply returns the amount issued by blocks 0 to height, never more than MaxSupply
+func (this *ChainParams) Supply(height int) int {
+	total := 0
+	// 每个减半周期内奖励金不变，逐个周期累加
+	for halvings := uint(0); halvings < 63; halvings++ {
+		start := int(halvings) * this.HalvingInterval
+		reward := this.Subsidy >> halvings
+		if start > height || reward == 0 {
+			break
+		}
+
+		end := start + this.HalvingInterval - 1
+		if end > height {
+			end = height
+		}
+		total += reward * (end - start + 1)
+		if total >= this.MaxSupply {
+			return this.MaxSupply
+		}
+	}
+
+	return total
+}
+
+// 创世块的难度
+func (this *ChainParams) genesisBits() uint32 {
+	return BigToCompact(new(big.Int).Lsh(big.NewInt(1), uint(256-this.TargetBits)))
+}
+
+// 目标值的上限，即最低难度
+func (this *ChainParams) powLimit() *big.Int {
+	return new(big.Int).Lsh(big.NewInt(1), uint(256-this.PowLimitBits))
+}
@@ -5,13 +5,30 @@
 package src
 
 import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
 	"flag"
 	"fmt"
+	"io/ioutil"
 	"log"
 	"os"
+	"runtime"
 	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/term"
+)
+
+const (
+	walletPassphraseEnv    = "WALLET_PASSPHRASE"     // 钱包口令，不设置时在终端输入
+	walletNewPassphraseEnv = "WALLET_NEW_PASSPHRASE" // change_passphrase 的新口令
 )
 
+var stdin = bufio.NewReader(os.Stdin)
+
 type CLI struct {
 	blockChain *BlockChain
 }
@@ -20,6 +37,7 @@ func (this *CLI) Run() {
 	var (
 		err error
 	)
+	this.selectNetwork()
 	this.validateArgs()
 
 	nodeID := os.Getenv("NODE_ID")
@@ -36,17 +54,57 @@ func (this *CLI) Run() {
 	createWalletCmd := flag.NewFlagSet("create_wallet", flag.ExitOnError)
 	listAddressesCmd := flag.NewFlagSet("list_addresses", flag.ExitOnError)
 	reindexUTXOCmd := flag.NewFlagSet("reindex_utxo", flag.ExitOnError)
+	supplyCmd := flag.NewFlagSet("supply", flag.ExitOnError)
+	createMultiSigCmd := flag.NewFlagSet("create_multisig", flag.ExitOnError)
+	createTxCmd := flag.NewFlagSet("create_tx", flag.ExitOnError)
+	signTxCmd := flag.NewFlagSet("sign_tx", flag.ExitOnError)
+	broadcastTxCmd := flag.NewFlagSet("broadcast_tx", flag.ExitOnError)
+	anchorCmd := flag.NewFlagSet("anchor", flag.ExitOnError)
+	findAnchorCmd := flag.NewFlagSet("find_anchor", flag.ExitOnError)
+	unlockCmd := flag.NewFlagSet("unlock", flag.ExitOnError)
+	restoreWalletCmd := flag.NewFlagSet("restore_wallet", flag.ExitOnError)
+	changePassphraseCmd := flag.NewFlagSet("change_passphrase", flag.ExitOnError)
+	exportKeyCmd := flag.NewFlagSet("export_key", flag.ExitOnError)
+	importKeyCmd := flag.NewFlagSet("import_key", flag.ExitOnError)
     startNodeCmd := flag.NewFlagSet("startnode", flag.ExitOnError)
 
 	getBalanceAddress := getBalanceCmd.String("address", "", "The address to get balance for")
-	addBlockData := addBlockCmd.String("data", "", "Block data")
+	listPublicKeys := listAddressesCmd.Bool("pubkeys", false, "Print the public key of each address")
+	createMultiSigRequired := createMultiSigCmd.Int("required", 0, "Number of signatures required")
+	createMultiSigKeys := createMultiSigCmd.String("keys", "",
+		"Comma separated public keys in hex, or addresses of this node's wallet")
+	createTxFrom := createTxCmd.String("from", "", "Source address, a plain or a multisig address")
+	createTxTo := createTxCmd.String("to", "", "Destination wallet address")
+	createTxAmount := createTxCmd.Int("amount", 0, "Amount to send")
+	createTxFee := createTxCmd.Int("fee", 0, "Fee paid to the miner")
+	createTxLockTime := createTxCmd.Int64("locktime", 0, "Block height or Unix time the transaction is locked until")
+	createTxFile := createTxCmd.String("file", "", "File to write the unsigned transaction to")
+	signTxFile := signTxCmd.String("file", "", "File of the transaction to sign")
+	signTxAddress := signTxCmd.String("address", "", "Address of this node's wallet to sign with")
+	broadcastTxFile := broadcastTxCmd.String("file", "", "File of the signed transaction")
+	addBlockAddress := addBlockCmd.String("address", "", "The address to send the block reward to")
+	addBlockData := addBlockCmd.String("data", "", "Data carried by the block's coinbase")
+	restoreWalletMnemonic := restoreWalletCmd.String("mnemonic", "", "The words written down by create_wallet")
+	exportKeyAddress := exportKeyCmd.String("address", "", "Address of this node's wallet")
+	importKeyWIF := importKeyCmd.String("wif", "", "Private key in WIF, as printed by export_key")
+	importKeyRescan := importKeyCmd.Bool("rescan", false, "Look up the outputs of the imported address in the chainstate")
+	anchorFrom := anchorCmd.String("from", "", "Wallet address paying the fee")
+	anchorFile := anchorCmd.String("file", "", "File whose SHA-256 is put on chain")
+	anchorFee := anchorCmd.Int("fee", 0, "Fee paid to the miner")
+	anchorMine := anchorCmd.Bool("mine", false, "Mine immediately on the same node")
+	findAnchorFile := findAnchorCmd.String("file", "", "File to look up")
+	findAnchorHash := findAnchorCmd.String("hash", "", "SHA-256 in hex to look up, instead of -file")
 	sendFrom := sendCmd.String("from", "", "Source wallet address")
 	sendTo := sendCmd.String("to", "", "Destination wallet address")
 	sendAmount := sendCmd.Int("amount", 0, "Amount to send")
+	sendFee := sendCmd.Int("fee", 0, "Fee paid to the miner")
+	sendLockTime := sendCmd.Int64("locktime", 0, "Block height, or Unix time when 500000000 or more, "+
+		"before which the transaction cannot be mined")
 	sendMine := sendCmd.Bool("mine", false, "Mine immediately on the same node")
 	createBlockChainAddress := createBlockChainCmd.String("address", "",
 		"The address to send genesis block reward to")
     startNodeMiner := startNodeCmd.String("miner", "", "Enable mining mode and send reward to ADDRESS")
+	startNodeWorkers := startNodeCmd.Int("workers", runtime.NumCPU(), "Number of goroutines used for mining")
 
 	switch os.Args[1] {
 	case "create_wallet":
@@ -83,6 +141,30 @@ func (this *CLI) Run() {
 		if err != nil {
 			log.Panic(err)
 		}
+	case "supply":
+		err = supplyCmd.Parse(os.Args[2:])
+	case "create_multisig":
+		err = createMultiSigCmd.Parse(os.Args[2:])
+	case "create_tx":
+		err = createTxCmd.Parse(os.Args[2:])
+	case "sign_tx":
+		err = signTxCmd.Parse(os.Args[2:])
+	case "broadcast_tx":
+		err = broadcastTxCmd.Parse(os.Args[2:])
+	case "anchor":
+		err = anchorCmd.Parse(os.Args[2:])
+	case "find_anchor":
+		err = findAnchorCmd.Parse(os.Args[2:])
+	case "restore_wallet":
+		err = restoreWalletCmd.Parse(os.Args[2:])
+	case "unlock":
+		err = unlockCmd.Parse(os.Args[2:])
+	case "change_passphrase":
+		err = changePassphraseCmd.Parse(os.Args[2:])
+	case "export_key":
+		err = exportKeyCmd.Parse(os.Args[2:])
+	case "import_key":
+		err = importKeyCmd.Parse(os.Args[2:])
     case "start_node":
         err := startNodeCmd.Parse(os.Args[2:])
         if err != nil {
@@ -97,11 +179,11 @@ func (this *CLI) Run() {
 	}
 
 	if addBlockCmd.Parsed() {
-		if *addBlockData == "" {
+		if *addBlockAddress == "" || *addBlockData == "" {
 			addBlockCmd.Usage()
 			os.Exit(1)
 		}
-		this.addBlock(*addBlockData)
+		this.AddBlock(*addBlockAddress, *addBlockData, nodeID)
 	}
 
 	if printChainCmd.Parsed() {
@@ -109,12 +191,12 @@ func (this *CLI) Run() {
 	}
 
 	if sendCmd.Parsed() {
-		if *sendFrom == "" || *sendTo == "" || *sendAmount <= 0 {
+		if *sendFrom == "" || *sendTo == "" || *sendAmount <= 0 || *sendFee < 0 || *sendLockTime < 0 {
 			sendCmd.Usage()
 			os.Exit(1)
 		}
 
-		this.Send(*sendFrom, *sendTo, *sendAmount, nodeID, *sendMine)
+		this.Send(*sendFrom, *sendTo, *sendAmount, *sendFee, *sendLockTime, nodeID, *sendMine)
 	}
 
 	if createBlockChainCmd.Parsed() {
@@ -138,36 +220,211 @@ func (this *CLI) Run() {
 	}
 
 	if listAddressesCmd.Parsed() {
-		this.ListAddresses(nodeID)
+		if *listPublicKeys {
+			this.ListPublicKeys(nodeID)
+		} else {
+			this.ListAddresses(nodeID)
+		}
 	}
 
 	if reindexUTXOCmd.Parsed() {
 		this.ReindexUTXO(nodeID)
 	}
 
+	if supplyCmd.Parsed() {
+		this.Supply(nodeID)
+	}
+
+	if createMultiSigCmd.Parsed() {
+		if *createMultiSigRequired <= 0 || *createMultiSigKeys == "" {
+			createMultiSigCmd.Usage()
+			os.Exit(1)
+		}
+		this.CreateMultiSig(*createMultiSigRequired, strings.Split(*createMultiSigKeys, ","), nodeID)
+	}
+
+	if createTxCmd.Parsed() {
+		if *createTxFrom == "" || *createTxTo == "" || *createTxAmount <= 0 || *createTxFee < 0 ||
+			*createTxLockTime < 0 || *createTxFile == "" {
+			createTxCmd.Usage()
+			os.Exit(1)
+		}
+		this.CreateTx(*createTxFrom, *createTxTo, *createTxAmount, *createTxFee, *createTxLockTime, *createTxFile,
+			nodeID)
+	}
+
+	if signTxCmd.Parsed() {
+		if *signTxFile == "" || *signTxAddress == "" {
+			signTxCmd.Usage()
+			os.Exit(1)
+		}
+		this.SignTx(*signTxFile, *signTxAddress, nodeID)
+	}
+
+	if broadcastTxCmd.Parsed() {
+		if *broadcastTxFile == "" {
+			broadcastTxCmd.Usage()
+			os.Exit(1)
+		}
+		this.BroadcastTx(*broadcastTxFile, nodeID)
+	}
+
+	if anchorCmd.Parsed() {
+		if *anchorFrom == "" || *anchorFile == "" || *anchorFee < 0 {
+			anchorCmd.Usage()
+			os.Exit(1)
+		}
+		this.Anchor(*anchorFrom, *anchorFile, *anchorFee, nodeID, *anchorMine)
+	}
+
+	if findAnchorCmd.Parsed() {
+		if (*findAnchorFile == "") == (*findAnchorHash == "") {
+			findAnchorCmd.Usage()
+			os.Exit(1)
+		}
+		this.FindAnchor(*findAnchorFile, *findAnchorHash, nodeID)
+	}
+
+	if restoreWalletCmd.Parsed() {
+		if *restoreWalletMnemonic == "" {
+			restoreWalletCmd.Usage()
+			os.Exit(1)
+		}
+		this.RestoreWallet(*restoreWalletMnemonic, nodeID)
+	}
+
+	if unlockCmd.Parsed() {
+		this.Unlock(nodeID)
+	}
+
+	if changePassphraseCmd.Parsed() {
+		this.ChangePassphrase(nodeID)
+	}
+
+	if exportKeyCmd.Parsed() {
+		if *exportKeyAddress == "" {
+			exportKeyCmd.Usage()
+			os.Exit(1)
+		}
+		this.ExportKey(*exportKeyAddress, nodeID)
+	}
+
+	if importKeyCmd.Parsed() {
+		if *importKeyWIF == "" {
+			importKeyCmd.Usage()
+			os.Exit(1)
+		}
+		this.ImportKey(*importKeyWIF, nodeID, *importKeyRescan)
+	}
+
     if startNodeCmd.Parsed() {
         nodeID := os.Getenv("NODE_ID")
         if nodeID == "" {
             startNodeCmd.Usage()
             os.Exit(1)
         }
+        SetMiningWorkers(*startNodeWorkers)
         this.startNode(nodeID, *startNodeMiner)
     }
 }
 
 func (this *CLI) printUsage() {
-	fmt.Println("Usage:")
+	fmt.Println("Usage: [-network mainnet|testnet|regtest] [-maturity N] [-halving N] [-max_supply N] COMMAND")
+	fmt.Println("  The network can also be set with the NETWORK env. var, mainnet by default")
+	fmt.Printf("  Block rewards can be spent N blocks after they are mined, %d on mainnet and testnet, %d on regtest. "+
+		"Set N with -maturity or the COINBASE_MATURITY env. var, e.g. -maturity 0 to spend the reward of "+
+		"create_block_chain right away. All nodes of a network must use the same value\n",
+		MainNetParams.CoinbaseMaturity, RegTestParams.CoinbaseMaturity)
+	fmt.Printf("  The block reward halves every -halving blocks (HALVING_INTERVAL env. var, %d on mainnet), "+
+		"no more rewards are paid once -max_supply coins are issued (MAX_SUPPLY env. var, %d on mainnet)\n",
+		MainNetParams.HalvingInterval, MainNetParams.MaxSupply)
 	fmt.Println("  create_block_chain -address ADDRESS - Create a blockchain and send genesis block reward " +
 		"to ADDRESS")
-	fmt.Println("  create_wallet - Generates a new key-pair and saves it into the wallet file")
+	fmt.Println("  create_wallet - Derives the next address of the wallet. The first call prints the mnemonic " +
+		"to write down, it is the backup of all addresses")
+	fmt.Println("  restore_wallet -mnemonic \"WORD1 WORD2 ...\" - Regenerate the wallet from its mnemonic and " +
+		"rescan the chain for its addresses")
 	fmt.Println("  get_balance -address ADDRESS - Get balance of ADDRESS")
-	fmt.Println("  list_addresses - Lists all addresses from the wallet file")
+	fmt.Println("  unlock - Check the wallet passphrase, and encrypt a wallet file written by an older version")
+	fmt.Println("  change_passphrase - Encrypt the wallet file with a new passphrase")
+	fmt.Println("  export_key -address ADDRESS - Print the private key of ADDRESS in WIF, anyone knowing it can " +
+		"spend the coins of ADDRESS")
+	fmt.Println("  import_key -wif WIF -rescan - Add the private key WIF to the wallet. Look up the coins of its " +
+		"address in the chainstate, when -rescan is set. The mnemonic does not back up imported keys")
+	fmt.Printf("  Commands using the wallet read its passphrase from the %s env. var or the terminal, "+
+		"change_passphrase reads the new one from %s\n", walletPassphraseEnv, walletNewPassphraseEnv)
+	fmt.Println("  list_addresses -pubkeys - Lists all addresses from the wallet file, with public keys when " +
+		"-pubkeys is set")
+	fmt.Println("  create_multisig -required M -keys KEY1,KEY2,... - Create an M-of-N multisig address from " +
+		"public keys or addresses of this wallet")
+	fmt.Println("  create_tx -from FROM -to TO -amount AMOUNT -fee FEE -locktime LOCKTIME -file FILE - Write an unsigned transaction " +
+		"and the outputs it spends to FILE. FROM needs no private key on this node")
+	fmt.Println("  sign_tx -file FILE -address ADDRESS - Add the signature of ADDRESS to the transaction in FILE, " +
+		"works offline")
+	fmt.Println("  broadcast_tx -file FILE - Send the fully signed transaction in FILE to the network")
+	fmt.Println("  add_block -address ADDRESS -data DATA - Mine a block paying the reward to ADDRESS, its coinbase " +
+		"carries DATA in a data output")
+	fmt.Printf("  anchor -from FROM -file FILE -fee FEE -mine - Put the SHA-256 of FILE on chain in a data output, "+
+		"paying FEE from FROM. Data outputs carry up to %d bytes. Mine on the same node, when -mine is set.\n",
+		MaxNullDataSize)
+	fmt.Println("  find_anchor -file FILE | -hash HASH - Find the transaction that first anchored FILE, or the " +
+		"SHA-256 HASH in hex")
 	fmt.Println("  print_chain - Print all the blocks of the blockchain")
 	fmt.Println("  reindex_utxo - Rebuilds the UTXO set")
-	fmt.Println("  send -from FROM -to TO -amount AMOUNT -mine - Send AMOUNT of coins from FROM address to " +
-		"TO. Mine on the same node, when -mine is set.")
-	fmt.Println("  start_node -miner ADDRESS - Start a node with ID specified in NODE_ID env. var. -miner " +
-		"enables mining")
+	fmt.Println("  supply - Print the amount of coins issued up to the tip and the next block reward")
+	fmt.Println("  send -from FROM -to TO -amount AMOUNT -fee FEE -locktime LOCKTIME -mine - Send AMOUNT of coins " +
+		"from FROM address to TO, paying FEE to the miner. The transaction cannot be mined before block height " +
+		"or Unix time LOCKTIME. Mine on the same node, when -mine is set.")
+	fmt.Println("  start_node -miner ADDRESS -workers N - Start a node with ID specified in NODE_ID env. var. " +
+		"-miner enables mining with N goroutines")
+}
+
+// 命令前可以修改的网络参数和对应的环境变量，见 ChainParams.Override
+var paramOptions = []struct{ option, env string }{
+	{"maturity", "COINBASE_MATURITY"},
+	{"halving", "HALVING_INTERVAL"},
+	{"max_supply", "MAX_SUPPLY"},
+}
+
+// 选择网络并修改网络参数：命令前的 -network 等参数优先，其次是环境变量，默认主网和它的预置参数
+func (this *CLI) selectNetwork() {
+	options := map[string]string{"network": os.Getenv("NETWORK")}
+	for _, param := range paramOptions {
+		options[param.option] = os.Getenv(param.env)
+	}
+	for len(os.Args) > 2 && strings.HasPrefix(os.Args[1], "-") {
+		option := strings.TrimLeft(os.Args[1], "-")
+		if _, ok := options[option]; !ok {
+			fmt.Printf("ERROR: unknown option %s\n", os.Args[1])
+			os.Exit(1)
+		}
+		options[option] = os.Args[2]
+		os.Args = append(os.Args[:1], os.Args[3:]...)
+	}
+
+	params := ActiveChainParams()
+	if name := options["network"]; name != "" {
+		var err error
+		if params, err = ChainParamsByName(name); nil != err {
+			fmt.Println("ERROR:", err)
+			os.Exit(1)
+		}
+	}
+	custom := *params // 改的是副本，预置的网络参数不变
+	for _, param := range paramOptions {
+		if options[param.option] == "" {
+			continue
+		}
+		value, err := strconv.Atoi(options[param.option])
+		if nil == err {
+			err = custom.Override(param.option, value)
+		}
+		if nil != err {
+			fmt.Printf("ERROR: -%s: %s\n", param.option, err)
+			os.Exit(1)
+		}
+	}
+	SetChainParams(&custom)
 }
 
 func (this *CLI) validateArgs() {
@@ -177,9 +434,26 @@ func (this *CLI) validateArgs() {
 	}
 }
 
-func (this *CLI) addBlock(data string) {
-	this.blockChain.AddBlock(data)
-	fmt.Println("Success!")
+// 挖一个块，coinbase 除了奖励 address，还用一个数据输出携带 data
+func (this *CLI) AddBlock(address, data string, nodeID string) {
+	if !ValidateAddress(address) {
+		panic("ERROR: Address is not valid")
+	}
+	if len(data) > MaxNullDataSize {
+		fmt.Printf("ERROR: Data must not be larger than %d bytes\n", MaxNullDataSize)
+		os.Exit(1)
+	}
+
+	blockChain := NewBlockChain(nodeID)
+	defer blockChain.db.Close()
+
+	cbTX := CreateCoinBaseTX(address, "", blockChain.GetBestHeight()+1)
+	cbTX.Vout = append(cbTX.Vout, TXOutput{0, NullDataScript([]byte(data))})
+	cbTX.SetID()
+
+	block := blockChain.MineBlock([]*Transaction{cbTX})
+	fmt.Printf("Hash rate: %.0f H/s\n", LastHashRate())
+	fmt.Printf("Success! Block %x at height %d\n", block.Hash, block.Height)
 }
 
 func (this *CLI) printChain() {
@@ -201,7 +475,7 @@ func (this *CLI) printChain() {
 	}
 }
 
-func (this *CLI) Send(from, to string, amount int, nodeID string, mineNow bool) {
+func (this *CLI) Send(from, to string, amount, fee int, lockTime int64, nodeID string, mineNow bool) {
 	if !ValidateAddress(from) {
 		panic("ERROR: Sender address is not valid")
 	}
@@ -210,38 +484,287 @@ func (this *CLI) Send(from, to string, amount int, nodeID string, mineNow bool)
 	}
 
 	blockChain := NewBlockChain(nodeID)
+	blockChain.LoadPending() // 不再花已经发出、还没打包的交易的输入
 	set := UTXOSet{blockChain}
 	defer blockChain.db.Close()
 
-	wallets, err := NewWallets(nodeID)
+	wallets := this.loadWallets(nodeID)
+	wallet := wallets.GetWallet(from)
+
+	tx := NewUnsignedTransaction(from, to, amount, fee, &set)
+	if lockTime > 0 {
+		tx.SetLockTime(lockTime)
+	}
+	blockChain.SignTransaction(tx, wallet.PrivateKey)
+
+	this.submit(blockChain, tx, from, fee, mineNow)
+	fmt.Println("Success!")
+}
+
+// 在本节点挖一个块打包交易，奖励给 miner；否则发给中心节点
+func (this *CLI) submit(blockChain *BlockChain, tx *Transaction, miner string, fee int, mineNow bool) {
+	if mineNow {
+		cbTX := CreateCoinBaseTXWithFees(miner, "", blockChain.GetBestHeight()+1, fee)
+		txs := []*Transaction{cbTX, tx}
+
+		block := blockChain.MineBlock(txs)
+		fmt.Printf("Mined block %x, hash rate: %.0f H/s\n", block.Hash, LastHashRate())
+	} else {
+		central, err := centralNode()
+		if nil == err {
+			err = sendTx(central, tx)
+		}
+		if nil == err {
+			err = blockChain.AddPending(tx)
+		}
+		if nil != err {
+			fmt.Printf("ERROR: %s\n", err)
+			os.Exit(1)
+		}
+	}
+}
+
+// 把文件的 SHA-256 放进一个数据输出上链，之后凭文件就能用 find_anchor 证明它在那个块之前已经存在
+func (this *CLI) Anchor(from, file string, fee int, nodeID string, mineNow bool) {
+	if !ValidateAddress(from) {
+		panic("ERROR: Sender address is not valid")
+	}
+	content, err := ioutil.ReadFile(file)
 	if nil != err {
 		panic(err)
 	}
+	hash := sha256.Sum256(content)
+
+	blockChain := NewBlockChain(nodeID)
+	blockChain.LoadPending() // 不再花已经发出、还没打包的交易的输入
+	set := UTXOSet{blockChain}
+	defer blockChain.db.Close()
+
+	wallets := this.loadWallets(nodeID)
 	wallet := wallets.GetWallet(from)
 
-	tx := NewUTXOTransaction(&wallet, to, amount, &set)
+	tx := NewNullDataTransaction(from, hash[:], fee, &set)
+	blockChain.SignTransaction(tx, wallet.PrivateKey)
 
-	if mineNow {
-		cbTX := CreateCoinBaseTX(from, "")
-		txs := []*Transaction{cbTX, tx}
+	this.submit(blockChain, tx, from, fee, mineNow)
+	fmt.Printf("Success! SHA-256 %x is anchored by transaction %x\n", hash, tx.ID)
+}
 
-		newBlock := blockChain.MineBlock(txs)
-		set.Update(newBlock)
+// 找到最早把文件（或给出的 SHA-256）上链的交易
+func (this *CLI) FindAnchor(file, hashHex, nodeID string) {
+	var hash []byte
+	if file != "" {
+		content, err := ioutil.ReadFile(file)
+		if nil != err {
+			panic(err)
+		}
+		sum := sha256.Sum256(content)
+		hash = sum[:]
 	} else {
-		sendTx(knownNodes[0], tx)
+		var err error
+		if hash, err = hex.DecodeString(hashHex); nil != err || len(hash) != sha256.Size {
+			fmt.Printf("ERROR: %s is not a SHA-256 hash\n", hashHex)
+			os.Exit(1)
+		}
 	}
 
-	fmt.Println("Success!")
+	blockChain := NewBlockChain(nodeID)
+	defer blockChain.db.Close()
+
+	tx, block, err := blockChain.FindNullData(hash)
+	if nil != err {
+		fmt.Printf("SHA-256 %x is not anchored\n", hash)
+		os.Exit(1)
+	}
+
+	fmt.Printf("SHA-256 %x is anchored by transaction %x\n", hash, tx.ID)
+	fmt.Printf("Block %x at height %d, time %s\n", block.Hash, block.Height,
+		time.Unix(block.Timestamp, 0).Format(time.RFC3339))
 }
 
 func (this *CLI) CreateWallet(nodeID string) {
-	wallets, _ := NewWallets(nodeID)
+	wallets := this.loadWallets(nodeID)
+	if !wallets.HasSeed() {
+		mnemonic := NewMnemonic()
+		if err := wallets.SetMnemonic(mnemonic); nil != err {
+			panic(err)
+		}
+		fmt.Println("Write down the mnemonic and keep it safe, restore_wallet regenerates every address from it:")
+		fmt.Printf("\n    %s\n\n", mnemonic)
+	}
 	address := wallets.CreateWallet()
-	wallets.SaveToFile(nodeID)
+	this.saveWallets(wallets, nodeID)
 
 	fmt.Printf("Your new address: %s\n", address)
 }
 
+// 由助记词恢复钱包，扫描整条链找回用过的地址。旧版本的钱包没有种子，恢复后原来的密钥仍然保留
+func (this *CLI) RestoreWallet(mnemonic, nodeID string) {
+	wallets := this.loadWallets(nodeID)
+	if err := wallets.SetMnemonic(mnemonic); nil != err {
+		fmt.Printf("ERROR: %s\n", err)
+		os.Exit(1)
+	}
+
+	blockChain := NewBlockChain(nodeID)
+	used := blockChain.UsedPubKeyHashes()
+	blockChain.db.Close()
+
+	restored := wallets.Restore(func(pubKeyHash []byte) bool {
+		return used[hex.EncodeToString(pubKeyHash)]
+	})
+	this.saveWallets(wallets, nodeID)
+
+	fmt.Printf("Restored %d used addresses, create_wallet derives the next one\n", restored)
+}
+
+// 检查口令能否解开钱包。旧版本写的明文钱包在这里设置口令并加密保存
+func (this *CLI) Unlock(nodeID string) {
+	wallets := this.loadWallets(nodeID)
+	if !wallets.HasPassphrase() {
+		this.saveWallets(wallets, nodeID)
+		fmt.Println("The wallet file is encrypted now")
+	}
+
+	fmt.Printf("Wallet unlocked: %d addresses, %d multisig addresses\n", len(wallets.Wallets),
+		len(wallets.MultiSigs))
+}
+
+// 用新口令重新加密钱包文件
+func (this *CLI) ChangePassphrase(nodeID string) {
+	wallets := this.loadWallets(nodeID)
+	if len(wallets.Wallets) == 0 && len(wallets.MultiSigs) == 0 {
+		fmt.Println("ERROR: The wallet is empty, create_wallet sets the passphrase of a new wallet")
+		os.Exit(1)
+	}
+	wallets.ChangePassphrase(newPassphrase(walletNewPassphraseEnv))
+	wallets.SaveToFile(nodeID)
+
+	fmt.Println("Passphrase changed")
+}
+
+// 以 WIF 格式打印地址的私钥，用来把密钥搬到别的节点
+func (this *CLI) ExportKey(address, nodeID string) {
+	wallets := this.loadWallets(nodeID)
+	wif, err := wallets.ExportKey(address)
+	if nil != err {
+		fmt.Printf("ERROR: %s\n", err)
+		os.Exit(1)
+	}
+
+	fmt.Println(wif)
+}
+
+// 导入 WIF 私钥。余额本来就按地址从 UTXO 集合查询，rescan 只是在 chainstate 中找出这个地址已有的输出
+func (this *CLI) ImportKey(wif, nodeID string, rescan bool) {
+	wallets := this.loadWallets(nodeID)
+	address, err := wallets.ImportKey(wif)
+	if nil != err {
+		fmt.Printf("ERROR: %s\n", err)
+		os.Exit(1)
+	}
+	this.saveWallets(wallets, nodeID)
+	fmt.Printf("Imported address: %s\n", address)
+
+	if !rescan {
+		return
+	}
+	blockChain := NewBlockChain(nodeID)
+	defer blockChain.db.Close()
+	set := UTXOSet{blockChain}
+
+	scriptPubKey, _ := AddressScript(address)
+	utxos := set.FindScriptUTXO(scriptPubKey)
+	balance := 0
+	for _, out := range utxos {
+		balance += out.Value
+	}
+	fmt.Printf("Found %d unspent outputs, balance %d\n", len(utxos), balance)
+}
+
+// 读取钱包。口令来自环境变量或终端输入；钱包文件还不存在时返回空钱包，第一次保存前再设置口令
+func (this *CLI) loadWallets(nodeID string) *Wallets {
+	walletFile := fmt.Sprintf(ActiveChainParams().WalletFile, nodeID)
+	content, err := ioutil.ReadFile(walletFile)
+	if os.IsNotExist(err) {
+		wallets, _ := NewWallets(nodeID, nil)
+		return wallets
+	}
+	if nil != err {
+		panic(err)
+	}
+
+	var passphrase []byte
+	if IsEncryptedWalletFile(content) {
+		passphrase = readPassphrase(walletPassphraseEnv, "Wallet passphrase: ")
+	} else {
+		fmt.Fprintf(os.Stderr, "WARNING: %s is not encrypted, run unlock to encrypt it\n", walletFile)
+	}
+	wallets, err := NewWallets(nodeID, passphrase)
+	if nil != err {
+		fmt.Printf("ERROR: %s\n", err)
+		os.Exit(1)
+	}
+
+	return wallets
+}
+
+// 保存钱包，新钱包和旧的明文钱包先设置口令
+func (this *CLI) saveWallets(wallets *Wallets, nodeID string) {
+	if !wallets.HasPassphrase() {
+		wallets.ChangePassphrase(newPassphrase(walletPassphraseEnv))
+	}
+	wallets.SaveToFile(nodeID)
+}
+
+// 设置新口令：环境变量优先，否则在终端输入两次
+func newPassphrase(env string) []byte {
+	if passphrase := os.Getenv(env); passphrase != "" {
+		return []byte(passphrase)
+	}
+
+	passphrase := readPassphrase("", "New wallet passphrase: ")
+	if !bytes.Equal(passphrase, readPassphrase("", "Repeat the passphrase: ")) {
+		fmt.Println("ERROR: Passphrases do not match")
+		os.Exit(1)
+	}
+
+	return passphrase
+}
+
+// 从环境变量 env 读取口令，没有设置时在终端输入，输入时不回显
+func readPassphrase(env, prompt string) []byte {
+	if passphrase := os.Getenv(env); env != "" && passphrase != "" {
+		return []byte(passphrase)
+	}
+
+	var (
+		line string
+		err  error
+	)
+	fmt.Fprint(os.Stderr, prompt)
+	if fd := int(os.Stdin.Fd()); term.IsTerminal(fd) {
+		var input []byte
+		input, err = term.ReadPassword(fd)
+		line = string(input)
+	} else {
+		line, err = stdin.ReadString('\n') // 不是终端时照常按行读取
+	}
+	fmt.Fprintln(os.Stderr)
+
+	passphrase := strings.TrimRight(line, "\r\n")
+	if passphrase == "" {
+		if nil != err {
+			fmt.Printf("ERROR: Cannot read the passphrase: %s\n", err)
+		} else {
+			fmt.Println("ERROR: The passphrase must not be empty")
+		}
+		os.Exit(1)
+	}
+
+	return []byte(passphrase)
+}
+
 func (this *CLI) CreateBlockChain(address, nodeID string) {
 	if !ValidateAddress(address) {
 		panic("ERROR: Address is not valid")
@@ -266,9 +789,11 @@ func (this *CLI) GetBalance(address, nodeID string) {
 	defer blockChain.db.Close()
 
 	balance := 0
-	pubKeyHash := Base58Decode([]byte(address))
-	pubKeyHash = pubKeyHash[1 : len(pubKeyHash) - 4]
-	utxos := set.FindUTXO(pubKeyHash)
+	scriptPubKey, err := AddressScript(address)
+	if nil != err {
+		panic(err)
+	}
+	utxos := set.FindScriptUTXO(scriptPubKey)
 
 	for _, out := range utxos {
 		balance += out.Value
@@ -278,15 +803,16 @@ func (this *CLI) GetBalance(address, nodeID string) {
 }
 
 func (this *CLI) ListAddresses(nodeID string) {
-	wallets, err := NewWallets(nodeID)
-	if nil != err {
-		panic(err)
-	}
+	wallets := this.loadWallets(nodeID)
 	addresses := wallets.GetAddresses()
 
 	for _, address := range addresses {
 		fmt.Println(address)
 	}
+	for address, redeemScript := range wallets.MultiSigs {
+		m, pubKeys, _ := ParseMultiSigScript(redeemScript)
+		fmt.Printf("%s (%d-of-%d multisig)\n", address, m, len(pubKeys))
+	}
 }
 
 func (this *CLI) PrintChain(nodeID string) {
@@ -300,6 +826,7 @@ func (this *CLI) PrintChain(nodeID string) {
 
 		fmt.Printf("============ Block %x ============\n", block.Hash)
 		fmt.Printf("Height      : %d\n", block.Height)
+		fmt.Printf("Bits        : %08x\n", block.Bits)
 		fmt.Printf("Prev. block : %x\n", block.PrevBlockHash)
 		pow := NewProofOfWork(block)
 		fmt.Printf("PoW         : %s\n\n", strconv.FormatBool(pow.Validate()))
@@ -324,6 +851,175 @@ func (this *CLI) ReindexUTXO(nodeID string) {
 	fmt.Printf("Done! There are %d transactions in the UTXO set.\n", count)
 }
 
+// 打印钱包中每个地址的公钥，交给别人创建多重签名地址
+func (this *CLI) ListPublicKeys(nodeID string) {
+	wallets := this.loadWallets(nodeID)
+
+	for _, address := range wallets.GetAddresses() {
+		wallet := wallets.GetWallet(address)
+		fmt.Printf("%s %x\n", address, wallet.PublicKey)
+	}
+}
+
+// 创建 M-of-N 多重签名地址，保存赎回脚本，之后这个节点就可以从该地址发起交易
+func (this *CLI) CreateMultiSig(required int, keys []string, nodeID string) {
+	wallets := this.loadWallets(nodeID)
+
+	var pubKeys [][]byte
+	for _, key := range keys {
+		if wallet, ok := wallets.Wallets[key]; ok {
+			pubKeys = append(pubKeys, wallet.PublicKey)
+			continue
+		}
+		pubKey, err := hex.DecodeString(key)
+		if nil != err {
+			fmt.Printf("ERROR: %s is neither a public key nor an address of this wallet\n", key)
+			os.Exit(1)
+		}
+		pubKeys = append(pubKeys, pubKey)
+	}
+	if required > len(pubKeys) {
+		fmt.Printf("ERROR: %d signatures required but only %d keys given\n", required, len(pubKeys))
+		os.Exit(1)
+	}
+
+	address := wallets.AddMultiSig(required, pubKeys)
+	this.saveWallets(wallets, nodeID)
+	redeemScript, _ := wallets.GetMultiSig(address)
+
+	fmt.Printf("Your new %d-of-%d multisig address: %s\n", required, len(pubKeys), address)
+	fmt.Printf("Redeem script: %s\n", redeemScript)
+}
+
+// 创建未签名的交易，连同它花的输出写到文件里。
+// 这个节点只需要知道地址，不需要私钥；多重签名地址要先用 create_multisig 记下赎回脚本
+func (this *CLI) CreateTx(from, to string, amount, fee int, lockTime int64, file, nodeID string) {
+	if !ValidateAddress(from) {
+		panic("ERROR: Sender address is not valid")
+	}
+	if !ValidateAddress(to) {
+		panic("ERROR: Recipient address is not valid")
+	}
+
+	var redeemScript Script
+	if fromScript, _ := AddressScript(from); fromScript.ScriptHash() != nil {
+		wallets := this.loadWallets(nodeID)
+		var ok bool
+		if redeemScript, ok = wallets.GetMultiSig(from); !ok {
+			fmt.Printf("ERROR: %s is not a multisig address of this wallet\n", from)
+			os.Exit(1)
+		}
+	}
+
+	blockChain := NewBlockChain(nodeID)
+	blockChain.LoadPending()
+	set := UTXOSet{blockChain}
+	defer blockChain.db.Close()
+
+	var tx *Transaction
+	if redeemScript != nil {
+		tx = NewMultiSigTransaction(redeemScript, to, amount, fee, &set)
+	} else {
+		tx = NewUnsignedTransaction(from, to, amount, fee, &set)
+	}
+	if lockTime > 0 {
+		tx.SetLockTime(lockTime)
+	}
+	partial, err := NewPartialTransaction(tx, &set)
+	if nil != err {
+		panic(err)
+	}
+	if err := partial.WriteFile(file); nil != err {
+		panic(err)
+	}
+
+	fmt.Printf("Unsigned transaction %x is written to %s\n", tx.ID, file)
+}
+
+// 用本节点钱包中的一个密钥给文件里的交易签名，签名写回文件。不需要区块链，可以在离线节点上执行
+func (this *CLI) SignTx(file, address, nodeID string) {
+	wallets := this.loadWallets(nodeID)
+	if _, ok := wallets.Wallets[address]; !ok {
+		fmt.Printf("ERROR: %s is not an address of this wallet\n", address)
+		os.Exit(1)
+	}
+	wallet := wallets.GetWallet(address)
+
+	partial, err := ReadPartialTransaction(file)
+	if nil != err {
+		panic(err)
+	}
+
+	// 签名之前先让用户核对要付给谁、付多少
+	partial.Tx.PrintTransaction()
+	fmt.Printf("Fee: %d (unverified: input amounts come from the file and are not covered by the signatures, "+
+		"check them against the chain)\n", partial.Fee())
+
+	signed, err := partial.Sign(wallet.PrivateKey)
+	if nil != err {
+		fmt.Printf("ERROR: %s\n", err)
+		os.Exit(1)
+	}
+	if signed == 0 {
+		fmt.Printf("ERROR: %s has nothing to sign in this transaction\n", address)
+		os.Exit(1)
+	}
+	if err := partial.WriteFile(file); nil != err {
+		panic(err)
+	}
+
+	for i, vin := range partial.Tx.Vin {
+		if have, need := vin.MultiSigProgress(); need > 0 {
+			fmt.Printf("Input %d: %d of %d signatures\n", i, have, need)
+		}
+	}
+	if partial.IsComplete() {
+		fmt.Println("Transaction is fully signed")
+	}
+}
+
+// 签名齐全后把交易发给中心节点
+func (this *CLI) BroadcastTx(file, nodeID string) {
+	partial, err := ReadPartialTransaction(file)
+	if nil != err {
+		panic(err)
+	}
+
+	blockChain := NewBlockChain(nodeID)
+	defer blockChain.db.Close()
+
+	if !blockChain.VerifyTransaction(&partial.Tx) {
+		fmt.Println("ERROR: Transaction is not fully signed")
+		os.Exit(1)
+	}
+	central, err := centralNode()
+	if nil == err {
+		err = sendTx(central, &partial.Tx)
+	}
+	if nil == err {
+		err = blockChain.AddPending(&partial.Tx)
+	}
+	if nil != err {
+		fmt.Printf("ERROR: %s\n", err)
+		os.Exit(1)
+	}
+
+	fmt.Println("Success!")
+}
+
+// 按减半规则统计到链尖为止发行了多少币
+func (this *CLI) Supply(nodeID string) {
+	blockChain := NewBlockChain(nodeID)
+	defer blockChain.db.Close()
+
+	params := ActiveChainParams()
+	height := blockChain.GetBestHeight()
+	fmt.Printf("Height: %d\n", height)
+	fmt.Printf("Issued: %d of %d\n", params.Supply(height), params.MaxSupply)
+	fmt.Printf("Next block reward: %d (halving every %d blocks)\n", params.BlockSubsidy(height+1),
+		params.HalvingInterval)
+}
+
 func (this *CLI) startNode(nodeID, minerAddress string) {
     fmt.Printf("Starting node %s\n", nodeID)
     if len(minerAddress) > 0 {
@@ -0,0 +1,98 @@
+// @Title HD 密钥
+// @Description BIP32：从一个种子按路径派生出任意多个私钥，备份种子就备份了全部密钥
+package src
+
+import (
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/sha512"
+	"encoding/binary"
+	"errors"
+	"math/big"
+)
+
+// HardenedKeyStart 及以上的序号是强化派生，只有私钥才能派生子密钥
+const HardenedKeyStart = 0x80000000
+
+var errInvalidChildKey = errors.New("derived key is invalid, use the next index")
+
+// 扩展私钥：私钥加上 32 字节的链码
+type hdKey struct {
+	key       []byte // 私钥，32 字节
+	chainCode []byte
+	curve     elliptic.Curve
+}
+
+// 由种子生成主密钥 m。旧版本的钱包用 P-256 派生，迁移时仍要按原来的曲线派生
+func newMasterKey(seed []byte, curve elliptic.Curve) (hdKey, error) {
+	mac := hmac.New(sha512.New, []byte("Bitcoin seed"))
+	mac.Write(seed)
+	sum := mac.Sum(nil)
+
+	k := new(big.Int).SetBytes(sum[:32])
+	if k.Sign() == 0 || k.Cmp(curve.Params().N) >= 0 {
+		return hdKey{}, errInvalidChildKey
+	}
+
+	return hdKey{sum[:32], sum[32:], curve}, nil
+}
+
+// 派生第 index 个子密钥：k_i = IL + k (mod n)，IL 是 HMAC-SHA512(链码, 数据) 的前 32 字节。
+// 强化派生的数据是 0x00 || k || index，普通派生的数据是压缩公钥 || index
+func (this hdKey) child(index uint32) (hdKey, error) {
+	curve := this.curve
+	var data []byte
+	if index >= HardenedKeyStart {
+		data = append([]byte{0}, this.key...)
+	} else {
+		x, y := scalarBaseMult(curve, this.key)
+		data = compressPoint(x, y)
+	}
+	data = append(data, make([]byte, 4)...)
+	binary.BigEndian.PutUint32(data[len(data)-4:], index)
+
+	mac := hmac.New(sha512.New, this.chainCode)
+	mac.Write(data)
+	sum := mac.Sum(nil)
+
+	n := curve.Params().N
+	il := new(big.Int).SetBytes(sum[:32])
+	if il.Cmp(n) >= 0 {
+		return hdKey{}, errInvalidChildKey
+	}
+	k := il.Add(il, new(big.Int).SetBytes(this.key))
+	k.Mod(k, n)
+	if k.Sign() == 0 {
+		return hdKey{}, errInvalidChildKey
+	}
+
+	return hdKey{k.FillBytes(make([]byte, 32)), sum[32:], curve}, nil
+}
+
+// 按路径依次派生
+func (this hdKey) derive(path []uint32) (hdKey, error) {
+	key := this
+	for _, index := range path {
+		var err error
+		if key, err = key.child(index); nil != err {
+			return hdKey{}, err
+		}
+	}
+
+	return key, nil
+}
+
+// 压缩公钥：0x02 或 0x03（y 的奇偶）加上 32 字节的 x
+func compressPoint(x, y *big.Int) []byte {
+	compressed := make([]byte, 33)
+	compressed[0] = 2 + byte(y.Bit(0))
+	x.FillBytes(compressed[1:])
+
+	return compressed
+}
+
+// 钱包第 index 个收款地址的派生路径 m/44'/coin'/0'/0/index
+func receivePath(index uint32) []uint32 {
+	return []uint32{44 + HardenedKeyStart, ActiveChainParams().HDCoinType + HardenedKeyStart, HardenedKeyStart, 0,
+		index}
+}
@@ -0,0 +1,351 @@
+package src
+
+import (
+	"bytes"
+	"encoding/hex"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/boltdb/bolt"
+)
+
+const (
+	mempoolThreshold = 2         // 内存池里攒够这么多笔交易，矿工节点才开始挖矿
+	maxBlockTxsSize  = 1 << 20   // 一个块里除 coinbase 外的交易最多占多少字节
+	pendingBucket    = "pending" // 本节点广播出去、还没有打包的交易
+)
+
+// 内存池，存放已经校验通过、还没有被打包进区块的交易
+type Mempool struct {
+	lock  sync.Mutex
+	txs   map[string]*mempoolEntry
+	spent map[string]string // 被池中交易花掉的输出 "txid:vout" -> 花掉它的交易 ID
+}
+
+// 池中的交易，以及入池时算出的手续费和序列化后的大小
+type mempoolEntry struct {
+	tx   Transaction
+	fee  int
+	size int
+}
+
+// 手续费率高的排在前面，费率相同时按交易 ID 排，保证结果稳定
+func (this *mempoolEntry) before(other *mempoolEntry) bool {
+	left, right := this.fee*other.size, other.fee*this.size
+	if left != right {
+		return left > right
+	}
+
+	return bytes.Compare(this.tx.ID, other.tx.ID) < 0
+}
+
+func NewMempool() *Mempool {
+	return &Mempool{
+		txs:   make(map[string]*mempoolEntry),
+		spent: make(map[string]string),
+	}
+}
+
+func outpointKey(txid []byte, vout int) string {
+	return fmt.Sprintf("%x:%d", txid, vout)
+}
+
+// Add 校验交易后放入内存池。
+// 交易的每个输入都必须引用 UTXO 集里还没花掉的输出，coinbase 的输出必须在下一个块已经成熟，
+// 锁定时间在下一个块已经到达，且不能和池中其他交易花同一个输出，签名也必须正确，
+// 金额都在 0 到 MaxSupply 之间，输出总额不能超过输入总额，差额就是手续费，数据输出不能超过 MaxNullDataSize 字节
+func (this *Mempool) Add(tx *Transaction, UTXOSet *UTXOSet) error {
+	txID := hex.EncodeToString(tx.ID)
+
+	if tx.IsCoinBase() {
+		return fmt.Errorf("transaction %s: coinbase transaction is not allowed in mempool", txID)
+	}
+	if len(tx.Vin) == 0 {
+		return fmt.Errorf("transaction %s: %w", txID, ErrNoInputs)
+	}
+	if this.Has(tx.ID) {
+		return fmt.Errorf("transaction %s: already in mempool", txID)
+	}
+	if !tx.IsFinal(UTXOSet.BlockChain.GetBestHeight()+1, time.Now().Unix()) {
+		return fmt.Errorf("transaction %s: locked until %d", txID, tx.LockTime)
+	}
+
+	seen := make(map[string]bool)
+	inputValue := 0
+	spendHeight := UTXOSet.BlockChain.GetBestHeight() + 1
+	for _, vin := range tx.Vin {
+		key := outpointKey(vin.Txid, vin.Vout)
+		if seen[key] {
+			return fmt.Errorf("transaction %s: output %s is spent twice", txID, key)
+		}
+		seen[key] = true
+
+		outs, _ := UTXOSet.FindOutputs(vin.Txid)
+		out, ok := outs.Outputs[vin.Vout]
+		if !ok {
+			return fmt.Errorf("transaction %s: output %s is spent or does not exist", txID, key)
+		}
+		if !outs.IsMature(spendHeight) {
+			return fmt.Errorf("transaction %s: coinbase output %s is not mature", txID, key)
+		}
+		inputValue += out.Value
+		if !validMoney(inputValue) {
+			return fmt.Errorf("transaction %s: %w: inputs are worth %d", txID, ErrBadValue, inputValue)
+		}
+	}
+	outputValue, err := sumOutputs(tx)
+	if nil != err {
+		return fmt.Errorf("transaction %s: %w: %v", txID, ErrBadValue, err)
+	}
+	for _, out := range tx.Vout {
+		if out.ScriptPubKey.isBadNullData() {
+			return fmt.Errorf("transaction %s: data output is malformed or larger than %d bytes", txID, MaxNullDataSize)
+		}
+	}
+	fee := inputValue - outputValue
+	if fee < 0 {
+		return fmt.Errorf("transaction %s: outputs are worth more than inputs", txID)
+	}
+
+	if !UTXOSet.BlockChain.VerifyTransaction(tx) {
+		return fmt.Errorf("transaction %s: invalid signature", txID)
+	}
+
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	if _, ok := this.txs[txID]; ok {
+		return fmt.Errorf("transaction %s: already in mempool", txID)
+	}
+	for key := range seen {
+		if other, ok := this.spent[key]; ok {
+			return fmt.Errorf("transaction %s: output %s is already spent by %s", txID, key, other)
+		}
+	}
+
+	this.txs[txID] = &mempoolEntry{*tx, fee, len(tx.Serialize())}
+	for key := range seen {
+		this.spent[key] = txID
+	}
+
+	return nil
+}
+
+// IsSpent reports whether a transaction in the mempool spends output vout of transaction txid
+func (this *Mempool) IsSpent(txid []byte, vout int) bool {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	_, ok := this.spent[outpointKey(txid, vout)]
+
+	return ok
+}
+
+// Has reports whether the transaction is in the mempool
+func (this *Mempool) Has(txID []byte) bool {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	_, ok := this.txs[hex.EncodeToString(txID)]
+
+	return ok
+}
+
+// Get returns a transaction from the mempool by its ID
+func (this *Mempool) Get(txID []byte) (Transaction, bool) {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	entry, ok := this.txs[hex.EncodeToString(txID)]
+	if !ok {
+		return Transaction{}, false
+	}
+
+	return entry.tx, true
+}
+
+// Fee returns the fee paid by a transaction in the mempool
+func (this *Mempool) Fee(txID []byte) (int, bool) {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	entry, ok := this.txs[hex.EncodeToString(txID)]
+	if !ok {
+		return 0, false
+	}
+
+	return entry.fee, true
+}
+
+// Count returns the number of transactions in the mempool
+func (this *Mempool) Count() int {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	return len(this.txs)
+}
+
+// Transactions returns all transactions in the mempool
+func (this *Mempool) Transactions() []*Transaction {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	var txs []*Transaction
+	for _, entry := range this.txs {
+		tx := entry.tx
+		txs = append(txs, &tx)
+	}
+
+	return txs
+}
+
+// SelectTransactions 为新块挑选交易：按手续费率从高到低放入，直到总大小达到 maxSize。
+// 返回挑中的交易和它们的手续费总额
+func (this *Mempool) SelectTransactions(maxSize int) ([]*Transaction, int) {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	entries := make([]*mempoolEntry, 0, len(this.txs))
+	for _, entry := range this.txs {
+		entries = append(entries, entry)
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].before(entries[j]) })
+
+	var txs []*Transaction
+	size, fees := 0, 0
+	for _, entry := range entries {
+		if size+entry.size > maxSize {
+			continue // 放不下就试试后面更小的交易
+		}
+		tx := entry.tx
+		txs = append(txs, &tx)
+		size += entry.size
+		fees += entry.fee
+	}
+
+	return txs, fees
+}
+
+// Remove 把交易移出内存池
+func (this *Mempool) Remove(txID []byte) {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	this.remove(hex.EncodeToString(txID))
+}
+
+func (this *Mempool) remove(txID string) {
+	entry, ok := this.txs[txID]
+	if !ok {
+		return
+	}
+
+	for _, vin := range entry.tx.Vin {
+		delete(this.spent, outpointKey(vin.Txid, vin.Vout))
+	}
+	delete(this.txs, txID)
+}
+
+// RemoveBlockTransactions 块入链后，移除已被打包的交易，以及和块中交易花了同一个输出的交易
+func (this *Mempool) RemoveBlockTransactions(block *Block) {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	for _, tx := range block.Transcations {
+		this.remove(hex.EncodeToString(tx.ID))
+
+		if tx.IsCoinBase() {
+			continue
+		}
+		for _, vin := range tx.Vin {
+			if other, ok := this.spent[outpointKey(vin.Txid, vin.Vout)]; ok {
+				this.remove(other)
+			}
+		}
+	}
+}
+
+// Prune 移除输入已经不在 UTXO 集里的交易，例如被重组后连接到主链上的块花掉了，
+// 以及重组后花了不再成熟的 coinbase 输出的交易
+func (this *Mempool) Prune(UTXOSet *UTXOSet) {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	spendHeight := UTXOSet.BlockChain.GetBestHeight() + 1
+	for txID, entry := range this.txs {
+		for _, vin := range entry.tx.Vin {
+			outs, _ := UTXOSet.FindOutputs(vin.Txid)
+			if _, ok := outs.Outputs[vin.Vout]; !ok || !outs.IsMature(spendHeight) {
+				this.remove(txID)
+				break
+			}
+		}
+	}
+}
+
+// AddPending remembers a transaction this node broadcast. 命令行进程看不到中心节点的内存池，
+// 下次构造交易之前用 LoadPending 把这些交易放进自己的内存池，选币时就不会再花它们的输入
+func (this *BlockChain) AddPending(tx *Transaction) error {
+	return this.db.Update(func(btx *bolt.Tx) error {
+		b, err := btx.CreateBucketIfNotExists([]byte(pendingBucket))
+		if nil != err {
+			return err
+		}
+
+		return b.Put(tx.ID, tx.Serialize())
+	})
+}
+
+// LoadPending puts the transactions recorded by AddPending into a new mempool of the chain, see SetMempool.
+// 输入已经不在 UTXO 集里的交易，要么已经打包，要么被别的交易抢先花了，删掉它们的记录
+func (this *BlockChain) LoadPending() {
+	var pending []Transaction
+	err := this.db.View(func(btx *bolt.Tx) error {
+		b := btx.Bucket([]byte(pendingBucket))
+		if b == nil {
+			return nil
+		}
+
+		return b.ForEach(func(k, v []byte) error {
+			pending = append(pending, DeserializeTransaction(v))
+			return nil
+		})
+	})
+	if nil != err {
+		panic(err)
+	}
+
+	pool := NewMempool()
+	set := UTXOSet{this}
+	var stale [][]byte
+	for i := range pending {
+		tx := &pending[i]
+		for _, vin := range tx.Vin {
+			if _, ok := set.FindOutput(vin.Txid, vin.Vout); !ok {
+				stale = append(stale, tx.ID)
+				break
+			}
+		}
+		_ = pool.Add(tx, &set) // 还没到锁定时间的交易留着记录，下次再试
+	}
+	this.SetMempool(pool)
+
+	if len(stale) == 0 {
+		return
+	}
+	err = this.db.Update(func(btx *bolt.Tx) error {
+		b := btx.Bucket([]byte(pendingBucket))
+		for _, txID := range stale {
+			if err := b.Delete(txID); nil != err {
+				return err
+			}
+		}
+
+		return nil
+	})
+	if nil != err {
+		panic(err)
+	}
+}
@@ -1,11 +1,14 @@
 package src
 
 import (
+    "bytes"
 	"crypto/sha256"
+    "fmt"
 )
 
 type MerkleTree struct {
-    RootNode *MerkleNode
+    RootNode  *MerkleNode
+    LeafCount int // 叶子数量，不含补齐用的复制节点
 }
 
 type MerkleNode struct {
@@ -14,11 +17,12 @@ type MerkleNode struct {
     Data  []byte
 }
 
+// 用数据构造默克尔树，每一层节点数为奇数时复制最后一个节点补齐
 func NewMerkleTree(data [][]byte) *MerkleTree {
     var nodes []MerkleNode
 
-    if len(data) % 2 != 0 {
-        data = append(data, data[len(data) - 1])
+    if len(data) == 0 {
+        return &MerkleTree{NewMerkleNode(nil, nil, nil), 0}
     }
 
     for _, datum := range data {
@@ -26,7 +30,11 @@ func NewMerkleTree(data [][]byte) *MerkleTree {
         nodes = append(nodes, *node)
     }
 
-    for i := 0; i < len(data)/2; i++ {
+    for len(nodes) > 1 || nodes[0].Left == nil { // 只有一个叶子时也要和自己合并一次
+        if len(nodes) % 2 != 0 {
+            nodes = append(nodes, nodes[len(nodes) - 1])
+        }
+
         var newLevel []MerkleNode
 
         for j := 0; j < len(nodes); j += 2 {
@@ -37,7 +45,7 @@ func NewMerkleTree(data [][]byte) *MerkleTree {
         nodes = newLevel
     }
 
-    mTree := MerkleTree{&nodes[0]}
+    mTree := MerkleTree{&nodes[0], len(data)}
 
     return &mTree
 }
@@ -49,7 +57,7 @@ func NewMerkleNode(left, right *MerkleNode, data []byte) *MerkleNode {
         hash := sha256.Sum256(data)
         mNode.Data = hash[:]
     } else {
-        prevHashes := append(left.Data, right.Data...)
+        prevHashes := append(append([]byte{}, left.Data...), right.Data...)
         hash := sha256.Sum256(prevHashes)
         mNode.Data = hash[:]
     }
@@ -60,5 +68,50 @@ func NewMerkleNode(left, right *MerkleNode, data []byte) *MerkleNode {
     return &mNode
 }
 
+// 默克尔证明中的一步：兄弟节点的哈希，以及兄弟节点在左边还是右边
+type MerkleProofNode struct {
+    Hash   []byte
+    IsLeft bool
+}
+
+// 返回第 index 个叶子到根的路径上所有兄弟节点，从叶子往上排列
+func (this *MerkleTree) Proof(index int) ([]MerkleProofNode, error) {
+    if index < 0 || index >= this.LeafCount {
+        return nil, fmt.Errorf("leaf index %d out of range [0, %d)", index, this.LeafCount)
+    }
+
+    depth := 0
+    for node := this.RootNode; node.Left != nil; node = node.Left {
+        depth++
+    }
+
+    // 从根往下走，index 的二进制从高到低每一位决定往左还是往右
+    var proof []MerkleProofNode
+    node := this.RootNode
+    for level := depth - 1; level >= 0; level-- {
+        if (index >> uint(level)) & 1 == 0 {
+            proof = append([]MerkleProofNode{{node.Right.Data, false}}, proof...)
+            node = node.Left
+        } else {
+            proof = append([]MerkleProofNode{{node.Left.Data, true}}, proof...)
+            node = node.Right
+        }
+    }
+
+    return proof, nil
+}
+
+// 用证明路径从叶子数据一路哈希到根，与 root 相同则说明叶子在树中
+func VerifyMerkleProof(leaf []byte, proof []MerkleProofNode, root []byte) bool {
+    node := NewMerkleNode(nil, nil, leaf)
 
+    for _, sibling := range proof {
+        if sibling.IsLeft {
+            node = NewMerkleNode(&MerkleNode{Data: sibling.Hash}, node, nil)
+        } else {
+            node = NewMerkleNode(node, &MerkleNode{Data: sibling.Hash}, nil)
+        }
+    }
 
+    return bytes.Equal(node.Data, root)
+}
@@ -0,0 +1,120 @@
+// @Title 助记词
+// @Description BIP39：用一组英文单词表示钱包的随机种子，抄下助记词就备份了 HD 钱包派生出的所有密钥
+package src
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/sha512"
+	"errors"
+	"fmt"
+	"math/big"
+	"strings"
+
+	"golang.org/x/crypto/pbkdf2"
+)
+
+const (
+	mnemonicEntropyBits = 128 // 新助记词的熵，对应 12 个单词
+	mnemonicSeedRounds  = 2048
+)
+
+// ErrBadMnemonic is returned for a mnemonic with unknown words, a wrong length or a wrong checksum
+var ErrBadMnemonic = errors.New("invalid mnemonic")
+
+// NewMnemonic generates a 12 word mnemonic from fresh random entropy
+func NewMnemonic() string {
+	entropy := make([]byte, mnemonicEntropyBits/8)
+	if _, err := rand.Read(entropy); nil != err {
+		panic(err)
+	}
+
+	mnemonic, err := EntropyToMnemonic(entropy)
+	if nil != err {
+		panic(err)
+	}
+
+	return mnemonic
+}
+
+// EntropyToMnemonic encodes 16 to 32 bytes of entropy as words, each word carrying 11 bits.
+// 熵后面追加 SHA-256 的前 len(entropy)/4 位作为校验和
+func EntropyToMnemonic(entropy []byte) (string, error) {
+	if len(entropy) < 16 || len(entropy) > 32 || len(entropy)%4 != 0 {
+		return "", fmt.Errorf("entropy of %d bytes, must be 16 to 32 and a multiple of 4", len(entropy))
+	}
+
+	checksumBits := len(entropy) / 4
+	hash := sha256.Sum256(entropy)
+	bits := new(big.Int).SetBytes(entropy)
+	bits.Lsh(bits, uint(checksumBits))
+	bits.Or(bits, big.NewInt(int64(hash[0]>>(8-checksumBits))))
+
+	count := (len(entropy)*8 + checksumBits) / 11
+	words := make([]string, count)
+	mask := big.NewInt(2047)
+	for i := count - 1; i >= 0; i-- {
+		words[i] = englishWordList[new(big.Int).And(bits, mask).Int64()]
+		bits.Rsh(bits, 11)
+	}
+
+	return strings.Join(words, " "), nil
+}
+
+// MnemonicToEntropy decodes the words and checks the checksum
+func MnemonicToEntropy(mnemonic string) ([]byte, error) {
+	words := strings.Fields(mnemonic)
+	if len(words) < 12 || len(words) > 24 || len(words)%3 != 0 {
+		return nil, fmt.Errorf("%w: %d words", ErrBadMnemonic, len(words))
+	}
+
+	bits := new(big.Int)
+	for _, word := range words {
+		index := wordIndex(word)
+		if index < 0 {
+			return nil, fmt.Errorf("%w: unknown word %q", ErrBadMnemonic, word)
+		}
+		bits.Lsh(bits, 11)
+		bits.Or(bits, big.NewInt(int64(index)))
+	}
+
+	checksumBits := len(words) * 11 / 33
+	checksum := new(big.Int).And(bits, big.NewInt(int64(1)<<uint(checksumBits)-1))
+	entropy := bits.Rsh(bits, uint(checksumBits)).FillBytes(make([]byte, checksumBits*4))
+
+	hash := sha256.Sum256(entropy)
+	if checksum.Int64() != int64(hash[0]>>(8-checksumBits)) {
+		return nil, fmt.Errorf("%w: wrong checksum", ErrBadMnemonic)
+	}
+
+	return entropy, nil
+}
+
+// MnemonicToSeed checks the mnemonic and stretches it with an optional passphrase into the 64 byte HD wallet seed
+func MnemonicToSeed(mnemonic, passphrase string) ([]byte, error) {
+	if _, err := MnemonicToEntropy(mnemonic); nil != err {
+		return nil, err
+	}
+	normalized := strings.Join(strings.Fields(strings.ToLower(mnemonic)), " ")
+
+	return pbkdf2.Key([]byte(normalized), []byte("mnemonic"+passphrase), mnemonicSeedRounds, 64, sha512.New), nil
+}
+
+// 词在词表中的序号，词表是排好序的，可以二分查找
+func wordIndex(word string) int {
+	word = strings.ToLower(word)
+	low, high := 0, len(englishWordList)
+	for low < high {
+		mid := (low + high) / 2
+		if englishWordList[mid] < word {
+			low = mid + 1
+		} else {
+			high = mid
+		}
+	}
+	if low < len(englishWordList) && englishWordList[low] == word {
+		return low
+	}
+
+	return -1
+}
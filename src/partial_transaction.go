@@ -0,0 +1,148 @@
+// @Title 待签名交易
+// @Description 把还没签完名的交易连同它花的输出一起导出到文件，离线节点不需要区块链就能核对并签名
+package src
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"encoding/gob"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"strings"
+)
+
+// 待签名的交易，以及每个输入所花的输出
+type PartialTransaction struct {
+	Tx          Transaction
+	PrevOutputs []SpentOutput // 与 Tx.Vin 一一对应
+}
+
+// NewPartialTransaction looks up the outputs spent by tx in the UTXO set
+func NewPartialTransaction(tx *Transaction, UTXOSet *UTXOSet) (*PartialTransaction, error) {
+	partial := PartialTransaction{Tx: *tx}
+
+	for _, vin := range tx.Vin {
+		outs, ok := UTXOSet.FindOutputs(vin.Txid)
+		out, found := outs.Outputs[vin.Vout]
+		if !ok || !found {
+			return nil, fmt.Errorf("output %s is spent or does not exist", outpointKey(vin.Txid, vin.Vout))
+		}
+		partial.PrevOutputs = append(partial.PrevOutputs, SpentOutput{vin.Txid, vin.Vout, out, outs.Height, outs.CoinBase})
+	}
+
+	return &partial, nil
+}
+
+// 签名和验证用的前序交易，只在被花的位置上有输出
+func (this *PartialTransaction) prevTXs() map[string]Transaction {
+	prevTXs := make(map[string]Transaction)
+	for _, prev := range this.PrevOutputs {
+		addPrevOutput(prevTXs, prev.Txid, prev.Vout, prev.Output)
+	}
+
+	return prevTXs
+}
+
+// 文件里的前序输出必须和交易的输入对得上，否则签名时无法找到要签的锁定脚本
+func (this *PartialTransaction) check() error {
+	if len(this.PrevOutputs) != len(this.Tx.Vin) {
+		return fmt.Errorf("transaction %x has %d inputs but %d previous outputs", this.Tx.ID,
+			len(this.Tx.Vin), len(this.PrevOutputs))
+	}
+	for i, vin := range this.Tx.Vin {
+		prev := this.PrevOutputs[i]
+		if !bytes.Equal(prev.Txid, vin.Txid) || prev.Vout != vin.Vout {
+			return fmt.Errorf("previous output %d does not match input %s", i, outpointKey(vin.Txid, vin.Vout))
+		}
+	}
+	if !bytes.Equal(this.Tx.ID, this.Tx.unsignedHash()) {
+		return fmt.Errorf("transaction %x has a wrong ID", this.Tx.ID)
+	}
+
+	return nil
+}
+
+// Sign adds the signatures of privKey: P2PKH inputs locked to its public key and multisig inputs it is a key of.
+// 返回签了几个输入
+func (this *PartialTransaction) Sign(privKey ecdsa.PrivateKey) (int, error) {
+	if err := this.check(); nil != err {
+		return 0, err
+	}
+
+	prevTXs := this.prevTXs()
+	signed := this.Tx.SignMultiSig(privKey, prevTXs)
+
+	pubKey := encodePubKey(privKey.PublicKey)
+	pubKeyHash := HashPubKey(pubKey)
+	for inID, vin := range this.Tx.Vin {
+		prevScript := this.PrevOutputs[inID].Output.ScriptPubKey
+		if len(vin.ScriptSig) == 0 && bytes.Equal(prevScript.PubKeyHash(), pubKeyHash) {
+			signature := signHash(privKey, this.Tx.SignatureHash(inID, prevScript))
+			this.Tx.Vin[inID].ScriptSig = SignatureScript(signature, pubKey)
+			signed++
+		}
+	}
+
+	return signed, nil
+}
+
+// IsComplete reports whether every input is signed well enough to be broadcast
+func (this *PartialTransaction) IsComplete() bool {
+	return this.check() == nil && this.Tx.Verify(this.prevTXs())
+}
+
+// Fee returns the difference between the spent outputs and the new outputs.
+// 输出的币值来自文件，签名并不覆盖它们，构造文件的人多报币值就能让手续费看起来比实际少，只能作参考
+func (this *PartialTransaction) Fee() int {
+	fee := 0
+	for _, prev := range this.PrevOutputs {
+		fee += prev.Output.Value
+	}
+	for _, out := range this.Tx.Vout {
+		fee -= out.Value
+	}
+
+	return fee
+}
+
+func (this *PartialTransaction) Serialize() []byte {
+	var buff bytes.Buffer
+
+	enc := gob.NewEncoder(&buff)
+	if err := enc.Encode(this); nil != err {
+		panic(err)
+	}
+
+	return buff.Bytes()
+}
+
+func DeserializePartialTransaction(data []byte) (*PartialTransaction, error) {
+	var partial PartialTransaction
+
+	dec := gob.NewDecoder(bytes.NewReader(data))
+	if err := dec.Decode(&partial); nil != err {
+		return nil, err
+	}
+
+	return &partial, nil
+}
+
+// WriteFile saves the transaction hex encoded, so it can be copied by hand
+func (this *PartialTransaction) WriteFile(file string) error {
+	return ioutil.WriteFile(file, []byte(hex.EncodeToString(this.Serialize())+"\n"), 0644)
+}
+
+// ReadPartialTransaction reads a file written by PartialTransaction.WriteFile
+func ReadPartialTransaction(file string) (*PartialTransaction, error) {
+	data, err := ioutil.ReadFile(file)
+	if nil != err {
+		return nil, err
+	}
+	decoded, err := hex.DecodeString(strings.TrimSpace(string(data)))
+	if nil != err {
+		return nil, fmt.Errorf("%s: %v", file, err)
+	}
+
+	return DeserializePartialTransaction(decoded)
+}
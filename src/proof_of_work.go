@@ -6,25 +6,39 @@ package src
 
 import (
     "bytes"
+    "context"
     "crypto/sha256"
-    "fmt"
     "math"
     "math/big"
+    "runtime"
+    "sync"
+    "sync/atomic"
+    "time"
+
+    "github.com/boltdb/bolt"
 )
 
+// 创世块难度、难度下限、调整周期和出块间隔见 ChainParams
 const (
-	targetBits = 24 // 算出来的hash开头必须是24个0（以二进制来计算的）
     maxNonce = math.MaxInt64 // 这个上限可真够大的，大概是 2^63 -1
+    maxRetargetFactor = 4 // 一次调整最多把难度放大或缩小到原来的几倍
+    checkInterval = 1 << 12 // 每个挖矿协程每算这么多次哈希检查一次是否被取消
+)
+
+var (
+    miningWorkers = runtime.NumCPU() // 并行挖矿的协程数
+    lastHashRate uint64 // 最近一次挖矿的算力，float64 的位表示，原子读写
 )
 
 type ProofOfWork struct {
-    block  *Block
-    target *big.Int
+    block             *Block
+    target            *big.Int
+    hashRate          float64 // 最近一次 Run 的算力，每秒哈希次数
+    coinBaseScriptSig []byte  // 加 extra nonce 之前 coinbase 的 ScriptSig，第一次加时保存
 }
 
 func NewProofOfWork(block *Block) *ProofOfWork {
-    target := big.NewInt(1)
-    target.Lsh(target, uint(256-targetBits)) // 左移 (256 - targetBits) 个比特位
+    target := CompactToBig(block.Bits) // 块头里记录的目标值
 
     return &ProofOfWork{
         target: target,
@@ -37,9 +51,9 @@ func NewProofOfWork(block *Block) *ProofOfWork {
 func (this *ProofOfWork) prepareData(nonce int) []byte {
     data := bytes.Join([][]byte{
         this.block.PrevBlockHash,
-        this.block.HashTranscations(),
+        this.block.MerkleRoot,
         IntToHex(this.block.Timestamp),
-        IntToHex(int64(targetBits)),
+        IntToHex(int64(this.block.Bits)),
         IntToHex(int64(nonce)),
     }, []byte{})
 
@@ -47,30 +61,132 @@ func (this *ProofOfWork) prepareData(nonce int) []byte {
 }
 
 // 核心算法
-func (this *ProofOfWork) Run() (int, []byte) {
-    var (
-    	hashInt big.Int
-    	hash [32]byte
-    	nonce = 0
-    )
+// nonce 空间按 miningWorkers 个协程交错切分，任意一个找到结果或 ctx 被取消时全部停止。
+// nonce 空间用完仍然没找到时，更新时间戳（或 coinbase 中的 extra nonce）后重新开始
+func (this *ProofOfWork) Run(ctx context.Context) (int, []byte, error) {
+    var hashes uint64
+    start := time.Now()
+    defer func() {
+        if elapsed := time.Since(start).Seconds(); elapsed > 0 {
+            this.hashRate = float64(atomic.LoadUint64(&hashes)) / elapsed
+        }
+        atomic.StoreUint64(&lastHashRate, math.Float64bits(this.hashRate))
+    }()
 
     //fmt.Printf("Mining the block containning \"%s\"\n", this.block.Data)
-    for nonce < maxNonce {
-        hash = sha256.Sum256(this.prepareData(nonce))
-        hashInt.SetBytes(hash[:]) // 将hash结果转换成一个大整数
-
-        if hashInt.Cmp(this.target) == -1 { // -1代表小于
-            // 找到小于目标上界的值了，工作量证明结束
-            fmt.Printf("\r%x", hash)
-            break
-        } else {
-            // 计算结果大于目标上界，继续寻找
-            nonce++
+    for extraNonce := 1; ; extraNonce++ {
+        nonce, hash, err := this.search(ctx, &hashes)
+        if nil != err || hash != nil {
+            return nonce, hash, err
         }
+
+        this.refreshHeader(extraNonce) // nonce 空间用完了
+    }
+}
+
+// 多个协程并行搜索整个 nonce 空间，没找到时返回的 hash 为 nil
+func (this *ProofOfWork) search(ctx context.Context, hashes *uint64) (int, []byte, error) {
+    type result struct {
+        nonce int
+        hash  [32]byte
+    }
+
+    ctx, cancel := context.WithCancel(ctx)
+    defer cancel()
+
+    workers := miningWorkers
+    results := make(chan result, workers)
+    var wg sync.WaitGroup
+
+    for w := 0; w < workers; w++ {
+        wg.Add(1)
+        go func(nonce int) {
+            var (
+                hashInt big.Int
+                count   uint64 // 本协程还没计入 hashes 的哈希次数
+            )
+            defer func() {
+                atomic.AddUint64(hashes, count)
+                wg.Done()
+            }()
+
+            for ; nonce < maxNonce-workers; nonce += workers {
+                if count++; count == checkInterval {
+                    atomic.AddUint64(hashes, count)
+                    count = 0
+                    select {
+                    case <-ctx.Done():
+                        return
+                    default:
+                    }
+                }
+
+                hash := sha256.Sum256(this.prepareData(nonce))
+                hashInt.SetBytes(hash[:]) // 将hash结果转换成一个大整数
+
+                if hashInt.Cmp(this.target) == -1 { // -1代表小于
+                    // 找到小于目标上界的值了，工作量证明结束
+                    results <- result{nonce, hash}
+                    cancel()
+                    return
+                }
+                // 计算结果大于目标上界，继续寻找
+            }
+        }(w)
+    }
+    wg.Wait()
+    close(results)
+
+    if found, ok := <-results; ok {
+        return found.nonce, found.hash[:], nil
+    }
+
+    return 0, nil, ctx.Err()
+}
+
+// nonce 空间用完后换一个块头：时间戳往前走了就用新的时间戳，否则修改 coinbase 里的 extra nonce，从而改变默克尔根。
+// extra nonce 总是加在原来的 ScriptSig 后面，不管之前加过没有
+func (this *ProofOfWork) refreshHeader(extraNonce int) {
+    if now := time.Now().Unix(); now > this.block.Timestamp {
+        this.block.Timestamp = now
+        return
+    }
+
+    if len(this.block.Transcations) == 0 || !this.block.Transcations[0].IsCoinBase() {
+        return
+    }
+    coinBase := this.block.Transcations[0]
+    if this.coinBaseScriptSig == nil {
+        this.coinBaseScriptSig = append([]byte{}, coinBase.Vin[0].ScriptSig...)
+    }
+    coinBase.Vin[0].ScriptSig = append(append([]byte{}, this.coinBaseScriptSig...), IntToHex(int64(extraNonce))...)
+    coinBase.SetID()
+    this.block.MerkleRoot = this.block.HashTranscations()
+}
+
+// HashRate returns hashes per second of the last Run
+func (this *ProofOfWork) HashRate() float64 {
+    return this.hashRate
+}
+
+// LastHashRate returns hashes per second of the last block mined by any ProofOfWork, e.g. by BlockChain.MineBlock
+func LastHashRate() float64 {
+    return math.Float64frombits(atomic.LoadUint64(&lastHashRate))
+}
+
+// SetMiningWorkers sets how many goroutines Run uses, at least 1
+func SetMiningWorkers(workers int) {
+    if workers < 1 {
+        workers = 1
     }
-    fmt.Println("\n\n")
+    miningWorkers = workers
+}
+
+// 找到一个满足目标的哈希平均需要的计算次数，即 2^256 / (target + 1)，用于比较分支的累计工作量
+func (this *ProofOfWork) Work() *big.Int {
+    denominator := new(big.Int).Add(this.target, big.NewInt(1))
 
-    return nonce, hash[:]
+    return new(big.Int).Div(new(big.Int).Lsh(big.NewInt(1), 256), denominator)
 }
 
 // 对工作量证明进行验证
@@ -84,3 +200,93 @@ func (this *ProofOfWork) Validate() bool {
     return hashInt.Cmp(this.target) == -1
 }
 
+// CompactToBig converts the compact representation of a target used in Block.Bits to a big integer.
+// 最高字节是以字节为单位的长度，低 3 字节是有效数字，与比特币的 nBits 相同
+func CompactToBig(compact uint32) *big.Int {
+    mantissa := int64(compact & 0x007fffff)
+    exponent := uint(compact >> 24)
+
+    var target *big.Int
+    if exponent <= 3 {
+        target = big.NewInt(mantissa >> (8 * (3 - exponent)))
+    } else {
+        target = new(big.Int).Lsh(big.NewInt(mantissa), 8*(exponent-3))
+    }
+    if compact&0x00800000 != 0 {
+        target.Neg(target)
+    }
+
+    return target
+}
+
+// BigToCompact converts a target to the compact representation used in Block.Bits, dropping
+// everything below the 3 most significant bytes
+func BigToCompact(target *big.Int) uint32 {
+    if target.Sign() == 0 {
+        return 0
+    }
+
+    var mantissa uint32
+    exponent := uint(len(target.Bytes()))
+    if exponent <= 3 {
+        mantissa = uint32(new(big.Int).Abs(target).Uint64()) << (8 * (3 - exponent))
+    } else {
+        mantissa = uint32(new(big.Int).Rsh(new(big.Int).Abs(target), 8*(exponent-3)).Uint64())
+    }
+
+    // 最高位是符号位，占用了就多挪一个字节
+    if mantissa&0x00800000 != 0 {
+        mantissa >>= 8
+        exponent++
+    }
+
+    compact := uint32(exponent<<24) | mantissa
+    if target.Sign() < 0 {
+        compact |= 0x00800000
+    }
+
+    return compact
+}
+
+// CalculateNextBits 根据上一个调整周期实际花费的时间调整目标值：出块太快就调低目标（更难），太慢就调高。
+// 实际时间被限制在期望时间的 1/4 到 4 倍之间，目标值不会超过当前网络的难度下限
+func CalculateNextBits(lastBits uint32, actualTimespan int64) uint32 {
+    params := ActiveChainParams()
+    expectedTimespan := int64(params.RetargetInterval - 1) * params.TargetBlockSpacing
+
+    // 分子分母同时乘上 maxRetargetFactor，限制范围时不会因为整除丢掉精度
+    numerator := actualTimespan * maxRetargetFactor
+    if numerator < expectedTimespan {
+        numerator = expectedTimespan
+    }
+    if numerator > expectedTimespan*maxRetargetFactor*maxRetargetFactor {
+        numerator = expectedTimespan * maxRetargetFactor * maxRetargetFactor
+    }
+
+    target := CompactToBig(lastBits)
+    target.Mul(target, big.NewInt(numerator))
+    target.Div(target, big.NewInt(expectedTimespan*maxRetargetFactor))
+    if powLimit := params.powLimit(); target.Cmp(powLimit) > 0 {
+        target.Set(powLimit)
+    }
+
+    return BigToCompact(target)
+}
+
+// 计算接在 prevBlock 后面的块应该使用的难度。每 RetargetInterval 个块调整一次，其余时候沿用父块的难度
+func nextBits(tx *bolt.Tx, prevBlock *Block) uint32 {
+    params := ActiveChainParams()
+    height := prevBlock.Height + 1
+    if params.NoRetargeting || height%params.RetargetInterval != 0 {
+        return prevBlock.Bits
+    }
+
+    // 找到本周期的第一个块，周期内共 RetargetInterval-1 个出块间隔
+    b := tx.Bucket([]byte(blocksBucket))
+    first := prevBlock
+    for i := 0; i < params.RetargetInterval-1; i++ {
+        first = DeserializeBlock(b.Get(first.PrevBlockHash))
+    }
+
+    return CalculateNextBits(prevBlock.Bits, prevBlock.Timestamp-first.Timestamp)
+}
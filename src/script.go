@@ -0,0 +1,653 @@
+// @Title 脚本
+// @Description 一个很小的基于栈的脚本引擎。输出用锁定脚本（ScriptPubKey）说明怎样才能花它，
+// 输入用解锁脚本（ScriptSig）提供签名等数据，先执行解锁脚本再执行锁定脚本，栈顶为真就可以花
+package src
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// 操作码，数值与比特币相同
+const (
+	OP_0                   = 0x00
+	OP_PUSHDATA1           = 0x4c // 后面 1 个字节是数据长度
+	OP_PUSHDATA2           = 0x4d // 后面 2 个字节（小端）是数据长度
+	OP_1NEGATE             = 0x4f
+	OP_1                   = 0x51 // OP_1 到 OP_16 把 1 到 16 压入栈
+	OP_16                  = 0x60
+	OP_VERIFY              = 0x69
+	OP_RETURN              = 0x6a
+	OP_DROP                = 0x75
+	OP_DUP                 = 0x76
+	OP_EQUAL               = 0x87
+	OP_EQUALVERIFY         = 0x88
+	OP_HASH160             = 0xa9
+	OP_CHECKSIG            = 0xac
+	OP_CHECKMULTISIG       = 0xae
+	OP_CHECKLOCKTIMEVERIFY = 0xb1
+)
+
+const (
+	maxScriptSize         = 10000 // 脚本最多多少字节
+	maxStackSize          = 1000  // 栈上最多多少个元素
+	maxScriptNumLen       = 5     // 作为数字使用的数据最多多少字节
+	maxPubKeysPerMultiSig = 20
+	MaxNullDataSize       = 80 // OP_RETURN 输出最多携带多少字节数据
+)
+
+var opcodeNames = map[byte]string{
+	OP_0:                   "OP_0",
+	OP_PUSHDATA1:           "OP_PUSHDATA1",
+	OP_PUSHDATA2:           "OP_PUSHDATA2",
+	OP_1NEGATE:             "OP_1NEGATE",
+	OP_VERIFY:              "OP_VERIFY",
+	OP_RETURN:              "OP_RETURN",
+	OP_DROP:                "OP_DROP",
+	OP_DUP:                 "OP_DUP",
+	OP_EQUAL:               "OP_EQUAL",
+	OP_EQUALVERIFY:         "OP_EQUALVERIFY",
+	OP_HASH160:             "OP_HASH160",
+	OP_CHECKSIG:            "OP_CHECKSIG",
+	OP_CHECKMULTISIG:       "OP_CHECKMULTISIG",
+	OP_CHECKLOCKTIMEVERIFY: "OP_CHECKLOCKTIMEVERIFY",
+}
+
+// 脚本执行失败时返回的错误都包装了 ErrScriptFailed
+var (
+	ErrScriptFailed    = errors.New("script failed")
+	ErrScriptMalformed = errors.New("script is malformed")
+)
+
+// 一段脚本，由操作码和要压栈的数据组成
+type Script []byte
+
+// 解析后的一条指令，data 只在压栈指令中使用
+type scriptOp struct {
+	opcode byte
+	data   []byte
+}
+
+// 验证脚本时需要交易提供的信息
+type SignatureChecker interface {
+	CheckSig(signature, pubKey []byte) bool // 签名是否由 pubKey 对应的私钥对本交易签出
+	CheckLockTime(lockTime int64) bool      // 交易的锁定时间是否已经达到 lockTime
+}
+
+// 拼接脚本
+type ScriptBuilder struct {
+	script Script
+}
+
+func NewScriptBuilder() *ScriptBuilder {
+	return &ScriptBuilder{}
+}
+
+func (this *ScriptBuilder) AddOp(opcode byte) *ScriptBuilder {
+	this.script = append(this.script, opcode)
+
+	return this
+}
+
+// AddData 用最短的方式压入数据
+func (this *ScriptBuilder) AddData(data []byte) *ScriptBuilder {
+	switch n := len(data); {
+	case n < OP_PUSHDATA1:
+		this.script = append(this.script, byte(n))
+	case n <= 0xff:
+		this.script = append(this.script, OP_PUSHDATA1, byte(n))
+	default:
+		length := make([]byte, 2)
+		binary.LittleEndian.PutUint16(length, uint16(n))
+		this.script = append(append(this.script, OP_PUSHDATA2), length...)
+	}
+	this.script = append(this.script, data...)
+
+	return this
+}
+
+// AddInt 压入一个数字，0 到 16 用对应的操作码
+func (this *ScriptBuilder) AddInt(n int64) *ScriptBuilder {
+	switch {
+	case n == 0:
+		return this.AddOp(OP_0)
+	case n == -1:
+		return this.AddOp(OP_1NEGATE)
+	case n >= 1 && n <= 16:
+		return this.AddOp(byte(OP_1 - 1 + n))
+	}
+
+	return this.AddData(encodeScriptNum(n))
+}
+
+func (this *ScriptBuilder) Script() Script {
+	return this.script
+}
+
+// PayToPubKeyHashScript 锁定给公钥哈希：OP_DUP OP_HASH160 <pubKeyHash> OP_EQUALVERIFY OP_CHECKSIG
+func PayToPubKeyHashScript(pubKeyHash []byte) Script {
+	return NewScriptBuilder().AddOp(OP_DUP).AddOp(OP_HASH160).AddData(pubKeyHash).
+		AddOp(OP_EQUALVERIFY).AddOp(OP_CHECKSIG).Script()
+}
+
+// MultiSigScript 需要 pubKeys 中 m 个公钥的签名：m <pubKey>... n OP_CHECKMULTISIG
+func MultiSigScript(m int, pubKeys [][]byte) Script {
+	builder := NewScriptBuilder().AddInt(int64(m))
+	for _, pubKey := range pubKeys {
+		builder.AddData(pubKey)
+	}
+
+	return builder.AddInt(int64(len(pubKeys))).AddOp(OP_CHECKMULTISIG).Script()
+}
+
+// PayToScriptHashScript 锁定给脚本哈希：OP_HASH160 <scriptHash> OP_EQUAL。
+// 花的时候解锁脚本最后压入原脚本（赎回脚本），再按赎回脚本的要求提供签名
+func PayToScriptHashScript(scriptHash []byte) Script {
+	return NewScriptBuilder().AddOp(OP_HASH160).AddData(scriptHash).AddOp(OP_EQUAL).Script()
+}
+
+// NullDataScript 只用来携带数据的输出，永远不能花：OP_RETURN <data>
+func NullDataScript(data []byte) Script {
+	return NewScriptBuilder().AddOp(OP_RETURN).AddData(data).Script()
+}
+
+// SignatureScript 花 P2PKH 输出用的解锁脚本：<signature> <pubKey>
+func SignatureScript(signature, pubKey []byte) Script {
+	return NewScriptBuilder().AddData(signature).AddData(pubKey).Script()
+}
+
+// 把脚本拆成一条条指令
+func (this Script) parse() ([]scriptOp, error) {
+	var ops []scriptOp
+
+	for i := 0; i < len(this); {
+		opcode := this[i]
+		i++
+
+		var length int
+		switch {
+		case opcode > OP_0 && opcode < OP_PUSHDATA1:
+			length = int(opcode)
+		case opcode == OP_PUSHDATA1:
+			if i+1 > len(this) {
+				return nil, fmt.Errorf("%w: truncated OP_PUSHDATA1", ErrScriptMalformed)
+			}
+			length = int(this[i])
+			i++
+		case opcode == OP_PUSHDATA2:
+			if i+2 > len(this) {
+				return nil, fmt.Errorf("%w: truncated OP_PUSHDATA2", ErrScriptMalformed)
+			}
+			length = int(binary.LittleEndian.Uint16(this[i:]))
+			i += 2
+		default:
+			ops = append(ops, scriptOp{opcode: opcode})
+			continue
+		}
+
+		if i+length > len(this) {
+			return nil, fmt.Errorf("%w: push of %d bytes past the end", ErrScriptMalformed, length)
+		}
+		ops = append(ops, scriptOp{opcode, this[i : i+length]})
+		i += length
+	}
+
+	return ops, nil
+}
+
+// IsPushOnly reports whether the script only pushes data
+func (this Script) IsPushOnly() bool {
+	ops, err := this.parse()
+	if nil != err {
+		return false
+	}
+	for _, op := range ops {
+		if op.opcode > OP_16 {
+			return false
+		}
+	}
+
+	return true
+}
+
+// IsUnspendable reports whether outputs locked by the script can never be spent
+func (this Script) IsUnspendable() bool {
+	return (len(this) > 0 && this[0] == OP_RETURN) || len(this) > maxScriptSize
+}
+
+// PubKeyHash returns the public key hash of a P2PKH script, or nil for other scripts
+func (this Script) PubKeyHash() []byte {
+	ops, err := this.parse()
+	if nil != err || len(ops) != 5 {
+		return nil
+	}
+	if ops[0].opcode != OP_DUP || ops[1].opcode != OP_HASH160 || len(ops[2].data) != 20 ||
+		ops[3].opcode != OP_EQUALVERIFY || ops[4].opcode != OP_CHECKSIG {
+		return nil
+	}
+
+	return ops[2].data
+}
+
+// ScriptHash returns the script hash of a P2SH script, or nil for other scripts
+func (this Script) ScriptHash() []byte {
+	ops, err := this.parse()
+	if nil != err || len(ops) != 3 {
+		return nil
+	}
+	if ops[0].opcode != OP_HASH160 || len(ops[1].data) != 20 || ops[2].opcode != OP_EQUAL {
+		return nil
+	}
+
+	return ops[1].data
+}
+
+// NullData returns the data carried by an OP_RETURN <data> script, ok is false for other scripts
+func (this Script) NullData() (data []byte, ok bool) {
+	ops, err := this.parse()
+	if nil != err || len(ops) == 0 || len(ops) > 2 || ops[0].opcode != OP_RETURN {
+		return nil, false
+	}
+	if len(ops) == 1 {
+		return []byte{}, true
+	}
+	if ops[1].data == nil && ops[1].opcode != OP_0 {
+		return nil, false
+	}
+
+	return ops[1].data, true
+}
+
+// 以 OP_RETURN 开头的输出只能是一条数据不超过 MaxNullDataSize 字节的 NullDataScript
+func (this Script) isBadNullData() bool {
+	if len(this) == 0 || this[0] != OP_RETURN {
+		return false
+	}
+	data, ok := this.NullData()
+
+	return !ok || len(data) > MaxNullDataSize
+}
+
+// Hash160 returns RIPEMD160(SHA256(script)), the hash a P2SH output is locked to
+func (this Script) Hash160() []byte {
+	return HashPubKey(this)
+}
+
+// ParseMultiSigScript returns the required number of signatures and the public keys of a multisig script
+func ParseMultiSigScript(script Script) (int, [][]byte, error) {
+	ops, err := script.parse()
+	if nil != err {
+		return 0, nil, err
+	}
+	if len(ops) < 4 || ops[len(ops)-1].opcode != OP_CHECKMULTISIG {
+		return 0, nil, fmt.Errorf("%w: not a multisig script", ErrScriptMalformed)
+	}
+
+	smallInt := func(op scriptOp) int {
+		if op.data != nil || op.opcode < OP_1 || op.opcode > OP_16 {
+			return 0
+		}
+		return int(op.opcode - OP_1 + 1)
+	}
+	m, n := smallInt(ops[0]), smallInt(ops[len(ops)-2])
+	if m == 0 || n == 0 || m > n || n != len(ops)-3 {
+		return 0, nil, fmt.Errorf("%w: bad multisig counts", ErrScriptMalformed)
+	}
+
+	var pubKeys [][]byte
+	for _, op := range ops[1 : len(ops)-2] {
+		if op.data == nil {
+			return 0, nil, fmt.Errorf("%w: multisig public key is not pushed data", ErrScriptMalformed)
+		}
+		pubKeys = append(pubKeys, op.data)
+	}
+
+	return m, pubKeys, nil
+}
+
+// PushedData returns the data pushed by the script, e.g. the signature and public key of a ScriptSig
+func (this Script) PushedData() [][]byte {
+	ops, err := this.parse()
+	if nil != err {
+		return nil
+	}
+
+	var pushes [][]byte
+	for _, op := range ops {
+		if op.data != nil {
+			pushes = append(pushes, op.data)
+		}
+	}
+
+	return pushes
+}
+
+// 反汇编成可读的形式，例如 OP_DUP OP_HASH160 89abcdef... OP_EQUALVERIFY OP_CHECKSIG
+func (this Script) String() string {
+	ops, err := this.parse()
+	if nil != err {
+		return fmt.Sprintf("[invalid script %x]", []byte(this))
+	}
+
+	var words []string
+	for _, op := range ops {
+		switch {
+		case op.data != nil:
+			words = append(words, hex.EncodeToString(op.data))
+		case op.opcode >= OP_1 && op.opcode <= OP_16:
+			words = append(words, fmt.Sprintf("OP_%d", op.opcode-OP_1+1))
+		case opcodeNames[op.opcode] != "":
+			words = append(words, opcodeNames[op.opcode])
+		default:
+			words = append(words, fmt.Sprintf("OP_UNKNOWN%d", op.opcode))
+		}
+	}
+
+	return strings.Join(words, " ")
+}
+
+// ExecuteScript 先执行解锁脚本，再在同一个栈上执行锁定脚本，结束时栈顶必须为真。
+// 解锁脚本只能压入数据，否则花费者可以用操作码绕过锁定脚本的检查
+func ExecuteScript(scriptSig, scriptPubKey Script, checker SignatureChecker) error {
+	if len(scriptSig) > maxScriptSize || len(scriptPubKey) > maxScriptSize {
+		return fmt.Errorf("%w: script is too large", ErrScriptFailed)
+	}
+	if !scriptSig.IsPushOnly() {
+		return fmt.Errorf("%w: signature script is not push only", ErrScriptFailed)
+	}
+
+	engine := scriptEngine{checker: checker}
+	if err := engine.execute(scriptSig); nil != err {
+		return err
+	}
+	sigStack := append([][]byte{}, engine.stack...)
+	if err := engine.execute(scriptPubKey); nil != err {
+		return err
+	}
+	if err := engine.checkResult(); nil != err {
+		return err
+	}
+
+	// P2SH：锁定脚本只检查了赎回脚本的哈希，还要用解锁脚本剩下的数据执行赎回脚本
+	if scriptPubKey.ScriptHash() == nil {
+		return nil
+	}
+	redeemScript := Script(sigStack[len(sigStack)-1])
+	engine.stack = sigStack[:len(sigStack)-1]
+	if err := engine.execute(redeemScript); nil != err {
+		return err
+	}
+
+	return engine.checkResult()
+}
+
+type scriptEngine struct {
+	stack   [][]byte
+	checker SignatureChecker
+}
+
+func (this *scriptEngine) push(data []byte) error {
+	if len(this.stack) >= maxStackSize {
+		return fmt.Errorf("%w: stack overflow", ErrScriptFailed)
+	}
+	this.stack = append(this.stack, data)
+
+	return nil
+}
+
+func (this *scriptEngine) pop() ([]byte, error) {
+	if len(this.stack) == 0 {
+		return nil, fmt.Errorf("%w: stack underflow", ErrScriptFailed)
+	}
+	top := this.stack[len(this.stack)-1]
+	this.stack = this.stack[:len(this.stack)-1]
+
+	return top, nil
+}
+
+func (this *scriptEngine) popInt() (int64, error) {
+	data, err := this.pop()
+	if nil != err {
+		return 0, err
+	}
+
+	return decodeScriptNum(data)
+}
+
+func (this *scriptEngine) execute(script Script) error {
+	ops, err := script.parse()
+	if nil != err {
+		return fmt.Errorf("%w: %v", ErrScriptFailed, err)
+	}
+
+	for _, op := range ops {
+		if err := this.step(op); nil != err {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// 执行一条指令
+func (this *scriptEngine) step(op scriptOp) error {
+	switch {
+	case op.data != nil:
+		return this.push(op.data)
+	case op.opcode == OP_0:
+		return this.push([]byte{})
+	case op.opcode == OP_1NEGATE:
+		return this.push(encodeScriptNum(-1))
+	case op.opcode >= OP_1 && op.opcode <= OP_16:
+		return this.push(encodeScriptNum(int64(op.opcode - OP_1 + 1)))
+	}
+
+	switch op.opcode {
+	case OP_RETURN:
+		return fmt.Errorf("%w: OP_RETURN", ErrScriptFailed)
+
+	case OP_VERIFY:
+		return this.verify("OP_VERIFY")
+
+	case OP_DROP:
+		_, err := this.pop()
+		return err
+
+	case OP_DUP:
+		if len(this.stack) == 0 {
+			return fmt.Errorf("%w: stack underflow", ErrScriptFailed)
+		}
+		return this.push(this.stack[len(this.stack)-1])
+
+	case OP_HASH160:
+		data, err := this.pop()
+		if nil != err {
+			return err
+		}
+		return this.push(HashPubKey(data))
+
+	case OP_EQUAL, OP_EQUALVERIFY:
+		a, err := this.pop()
+		if nil != err {
+			return err
+		}
+		b, err := this.pop()
+		if nil != err {
+			return err
+		}
+		if err := this.push(boolToStack(bytes.Equal(a, b))); nil != err {
+			return err
+		}
+		if op.opcode == OP_EQUALVERIFY {
+			return this.verify("OP_EQUALVERIFY")
+		}
+		return nil
+
+	case OP_CHECKSIG:
+		pubKey, err := this.pop()
+		if nil != err {
+			return err
+		}
+		signature, err := this.pop()
+		if nil != err {
+			return err
+		}
+		return this.push(boolToStack(this.checker.CheckSig(signature, pubKey)))
+
+	case OP_CHECKMULTISIG:
+		return this.checkMultiSig()
+
+	case OP_CHECKLOCKTIMEVERIFY:
+		// 只检查不出栈，锁定时间一般紧跟 OP_DROP
+		if len(this.stack) == 0 {
+			return fmt.Errorf("%w: stack underflow", ErrScriptFailed)
+		}
+		lockTime, err := decodeScriptNum(this.stack[len(this.stack)-1])
+		if nil != err {
+			return err
+		}
+		if lockTime < 0 || !this.checker.CheckLockTime(lockTime) {
+			return fmt.Errorf("%w: lock time %d is not reached", ErrScriptFailed, lockTime)
+		}
+		return nil
+	}
+
+	return fmt.Errorf("%w: unknown opcode 0x%02x", ErrScriptFailed, op.opcode)
+}
+
+func (this *scriptEngine) checkResult() error {
+	if len(this.stack) == 0 || !castToBool(this.stack[len(this.stack)-1]) {
+		return fmt.Errorf("%w: false on top of the stack", ErrScriptFailed)
+	}
+
+	return nil
+}
+
+func (this *scriptEngine) verify(name string) error {
+	top, err := this.pop()
+	if nil != err {
+		return err
+	}
+	if !castToBool(top) {
+		return fmt.Errorf("%w: %s", ErrScriptFailed, name)
+	}
+
+	return nil
+}
+
+// 栈上依次是 m 个签名、m、n 个公钥、n（n 在栈顶）。
+// 签名必须按公钥的顺序排列，每个公钥最多匹配一个签名
+func (this *scriptEngine) checkMultiSig() error {
+	n, err := this.popInt()
+	if nil != err {
+		return err
+	}
+	if n < 0 || n > maxPubKeysPerMultiSig {
+		return fmt.Errorf("%w: %d public keys", ErrScriptFailed, n)
+	}
+	pubKeys := make([][]byte, n)
+	for i := n - 1; i >= 0; i-- {
+		if pubKeys[i], err = this.pop(); nil != err {
+			return err
+		}
+	}
+
+	m, err := this.popInt()
+	if nil != err {
+		return err
+	}
+	if m < 0 || m > n {
+		return fmt.Errorf("%w: %d of %d signatures", ErrScriptFailed, m, n)
+	}
+	signatures := make([][]byte, m)
+	for i := m - 1; i >= 0; i-- {
+		if signatures[i], err = this.pop(); nil != err {
+			return err
+		}
+	}
+
+	success := true
+	for len(signatures) > 0 {
+		if len(signatures) > len(pubKeys) {
+			success = false
+			break
+		}
+		if this.checker.CheckSig(signatures[0], pubKeys[0]) {
+			signatures = signatures[1:]
+		}
+		pubKeys = pubKeys[1:]
+	}
+
+	return this.push(boolToStack(success))
+}
+
+// 数字用小端存储，最高字节的最高位是符号位
+func encodeScriptNum(n int64) []byte {
+	if n == 0 {
+		return []byte{}
+	}
+
+	negative := n < 0
+	if negative {
+		n = -n
+	}
+	var result []byte
+	for n > 0 {
+		result = append(result, byte(n&0xff))
+		n >>= 8
+	}
+	if result[len(result)-1]&0x80 != 0 {
+		extra := byte(0x00)
+		if negative {
+			extra = 0x80
+		}
+		result = append(result, extra)
+	} else if negative {
+		result[len(result)-1] |= 0x80
+	}
+
+	return result
+}
+
+func decodeScriptNum(data []byte) (int64, error) {
+	if len(data) > maxScriptNumLen {
+		return 0, fmt.Errorf("%w: number of %d bytes is too long", ErrScriptFailed, len(data))
+	}
+	if len(data) == 0 {
+		return 0, nil
+	}
+
+	var n int64
+	for i, b := range data {
+		n |= int64(b) << uint(8*i)
+	}
+	if data[len(data)-1]&0x80 != 0 {
+		n &= ^(int64(0x80) << uint(8*(len(data)-1)))
+		return -n, nil
+	}
+
+	return n, nil
+}
+
+func castToBool(data []byte) bool {
+	for i, b := range data {
+		if b != 0 {
+			// 负零也是假
+			return !(i == len(data)-1 && b == 0x80)
+		}
+	}
+
+	return false
+}
+
+func boolToStack(value bool) []byte {
+	if value {
+		return []byte{1}
+	}
+
+	return []byte{}
+}
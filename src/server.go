@@ -2,22 +2,38 @@ package src
 
 import (
 	"bytes"
+    "context"
 	"encoding/gob"
+    "encoding/hex"
+    "errors"
     "fmt"
+    "io"
     "io/ioutil"
     "net"
+    "sync"
+    "time"
 )
 
 var (
     nodeAddress string
     miningAddress string
-    knownNodes = []string{"localhost:3000"}
+    knownNodes = append([]string{}, ActiveChainParams().SeedNodes...)
+    knownNodesLock sync.Mutex // knownNodes 会被多个连接协程同时修改
+    blocksInTransit [][]byte // 已经知道但还没下载的块，按从旧到新排列
+    rejectedBlocks = make(map[string]bool) // 校验失败的块，不再下载；接在它们后面的块也接不上
+    syncLock sync.Mutex // 保护 blocksInTransit 和 rejectedBlocks
+    mempool = NewMempool() // 还没打包进区块的交易
+    miningCancel context.CancelFunc // 取消正在挖的块
+    miningLock sync.Mutex // 保护 miningCancel
 )
 
+var errNoKnownNodes = errors.New("no known nodes")
+
 const (
     commandLength = 12
     protocol = "tcp"
     nodeVersion = 1
+    dialTimeout = 5 * time.Second
 )
 
 type addr struct {
@@ -39,6 +55,25 @@ type getblocks struct {
     AddrFrom string
 }
 
+type block struct {
+    AddrFrom string
+    Block []byte
+}
+
+// 库存清单，告诉对方自己有哪些块或交易（只有哈希）
+type inv struct {
+    AddrFrom string
+    Type string // "block" 或 "tx"
+    Items [][]byte
+}
+
+// 按哈希请求某个块或交易的完整数据
+type getdata struct {
+    AddrFrom string
+    Type string
+    ID []byte
+}
+
 func commandToBytes(command string) []byte {
 	var bytes [commandLength]byte // 12 字节的缓冲区
 
@@ -61,14 +96,29 @@ func bytesToCommand(bytes []byte) string {
     return fmt.Sprintf("%s", command)
 }
 
-func sendData(address string, data []byte) {}
+// 把带命令前缀的数据发送给 address 节点，连不上的节点会从 knownNodes 中移除
+func sendData(address string, data []byte) error {
+    conn, err := net.DialTimeout(protocol, address, dialTimeout)
+    if nil != err {
+        fmt.Printf("%s is not available\n", address)
+        removeNode(address)
+        return fmt.Errorf("send to %s: %v", address, err)
+    }
+    defer conn.Close()
+
+    if _, err = io.Copy(conn, bytes.NewReader(data)); nil != err {
+        return fmt.Errorf("send to %s: %v", address, err)
+    }
 
-func sendTx(address string, tnx *Transaction) {
+    return nil
+}
+
+func sendTx(address string, tnx *Transaction) error {
 	data := tx{nodeAddress, tnx.Serialize()}
 	payload := gobEncode(data)
 	request := append(commandToBytes("tx"), payload...)
 
-	sendData(address, request)
+	return sendData(address, request)
 }
 
 func gobEncode(data interface{}) []byte {
@@ -93,9 +143,14 @@ func StartServer(nodeID, minerAddress string) {
     defer ln.Close()
 
     blockChain := NewBlockChain(nodeID)
+    blockChain.SetMempool(mempool) // 重组撤下来的交易重新等待打包
 
-    if nodeAddress != knownNodes[0] {
-        sendVersion(knownNodes[0], blockChain) // 查询是否自己的区块链已过时
+    if central, err := centralNode(); nil != err {
+        fmt.Println(err)
+    } else if nodeAddress != central {
+        if err := sendVersion(central, blockChain); nil != err { // 查询是否自己的区块链已过时
+            fmt.Println(err)
+        }
     }
 
     for {
@@ -107,10 +162,18 @@ func StartServer(nodeID, minerAddress string) {
     }
 }
 
+// 消息来自其他节点，读不出来、太短或者格式不对都只打印错误并丢弃，不能让节点崩溃
 func handleConnection(conn net.Conn, blockChain *BlockChain) {
+    defer conn.Close()
+
     request, err := ioutil.ReadAll(conn)
     if nil != err {
-        panic(err)
+        fmt.Printf("Cannot read from %s: %v\n", conn.RemoteAddr(), err)
+        return
+    }
+    if len(request) < commandLength {
+        fmt.Printf("Dropping a message of %d bytes from %s\n", len(request), conn.RemoteAddr())
+        return
     }
 
     command := bytesToCommand(request[:commandLength])
@@ -119,69 +182,331 @@ func handleConnection(conn net.Conn, blockChain *BlockChain) {
     switch command {
     case "addr":
         handleAddr(request)
+    case "block":
+        handleBlock(request, blockChain)
+    case "inv":
+        handleInv(request, blockChain)
+    case "getblocks":
+        handleGetBlocks(request, blockChain)
+    case "getdata":
+        handleGetData(request, blockChain)
+    case "tx":
+        handleTx(request, blockChain)
     case "version":
         handleVersion(request, blockChain)
     default:
         fmt.Println("Unknown command!")
     }
-
-    conn.Close()
 }
 
-func snedVersion(address string, blockChain *BlockChain) {
-    bestHeight := blockChain.GetBestHeight()
-    payload := gobEncode(version{nodeVersion, bestHeight, nodeAddress})
-
-    request := append(commandToBytes("version"), payload...)
+// 解码命令后面的数据，格式不对时返回错误，调用者丢弃这条消息
+func decodePayload(request []byte, payload interface{}) error {
+    if err := gob.NewDecoder(bytes.NewReader(request[commandLength:])).Decode(payload); nil != err {
+        return fmt.Errorf("dropping malformed %s message: %v", bytesToCommand(request[:commandLength]), err)
+    }
 
-    sendData(address, request)
+    return nil
 }
 
 func handleVersion(request []byte, bc *BlockChain) {
-    var (
-        buff bytes.Buffer
-        payload version
-    )
-
-    buff.Write(request[commandLength:])
-    dec := gob.NewDecoder(&buff)
-    err := dec.Decode(&payload)
+    var payload version
+    err := decodePayload(request, &payload)
     if nil != err {
-        panic(err)
+        fmt.Println(err)
+        return
     }
 
     myBestHeight := bc.GetBestHeight()
     foreignerBestHeight := payload.BestHeight
 
+    addNodes(payload.AddrFrom)
+
     if myBestHeight < foreignerBestHeight {
-        sendGetBlocks(payload.AddrFrom) // 对方的区块链更长，请求下载块
+        err = sendGetBlocks(payload.AddrFrom) // 对方的区块链更长，请求下载块
     } else if myBestHeight > foreignerBestHeight {
-        sendVersion(payload.AddrFrom, bc) // 自身的区块链更长，回复 version 消息
+        err = sendVersion(payload.AddrFrom, bc) // 自身的区块链更长，回复 version 消息
     }
-
-    if !nodeIsKnown(payload.AddrFrom) {
-        knownNodes = append(knownNodes, payload.AddrFrom)
+    if nil != err {
+        fmt.Println(err)
     }
 }
 
-func sendVersion(address string, blockChain *BlockChain) {
+func sendVersion(address string, blockChain *BlockChain) error {
     bestHeight := blockChain.GetBestHeight()
     payload := gobEncode(version{nodeVersion, bestHeight, nodeAddress})
 
     request := append(commandToBytes("version"), payload...)
 
-    sendData(address, request)
+    return sendData(address, request)
 }
 
 
-func sendGetBlocks(address string) {
+func sendGetBlocks(address string) error {
     payload := gobEncode(getblocks{nodeAddress})
     request := append(commandToBytes("getblocks"), payload...)
 
-    sendData(address, request)
+    return sendData(address, request)
+}
+
+func sendInv(address, kind string, items [][]byte) error {
+    payload := gobEncode(inv{nodeAddress, kind, items})
+    request := append(commandToBytes("inv"), payload...)
+
+    return sendData(address, request)
+}
+
+func sendGetData(address, kind string, id []byte) error {
+    payload := gobEncode(getdata{nodeAddress, kind, id})
+    request := append(commandToBytes("getdata"), payload...)
+
+    return sendData(address, request)
+}
+
+func sendBlock(address string, b *Block) error {
+    payload := gobEncode(block{nodeAddress, b.Serialize()})
+    request := append(commandToBytes("block"), payload...)
+
+    return sendData(address, request)
+}
+
+// 对方请求我们的区块列表，回复一份包含所有块哈希的库存清单
+func handleGetBlocks(request []byte, bc *BlockChain) {
+    var payload getblocks
+    err := decodePayload(request, &payload)
+    if nil != err {
+        fmt.Println(err)
+        return
+    }
+
+    if err = sendInv(payload.AddrFrom, "block", bc.GetBlockHashes(0, bc.GetBestHeight())); nil != err {
+        fmt.Println(err)
+    }
+}
+
+func handleInv(request []byte, bc *BlockChain) {
+    var payload inv
+    err := decodePayload(request, &payload)
+    if nil != err {
+        fmt.Println(err)
+        return
+    }
+
+    fmt.Printf("Received inventory with %d %s\n", len(payload.Items), payload.Type)
+
+    switch payload.Type {
+    case "block":
+        // 清单按高度从低到高排列，按顺序下载，保证每个块到达时父块已经在本地。
+        // 正在同步时只把新的块排到后面，由 handleBlock 接着下载
+        syncLock.Lock()
+        queued := make(map[string]bool)
+        for _, blockHash := range blocksInTransit {
+            queued[hex.EncodeToString(blockHash)] = true
+        }
+        syncing := len(blocksInTransit) > 0
+        for _, blockHash := range payload.Items {
+            id := hex.EncodeToString(blockHash)
+            if !bc.HasBlock(blockHash) && !queued[id] && !rejectedBlocks[id] {
+                blocksInTransit = append(blocksInTransit, blockHash)
+                queued[id] = true
+            }
+        }
+        var next []byte
+        if !syncing && len(blocksInTransit) > 0 {
+            next = blocksInTransit[0]
+            blocksInTransit = blocksInTransit[1:]
+        }
+        syncLock.Unlock()
+
+        if next != nil {
+            err = sendGetData(payload.AddrFrom, "block", next)
+        }
+    case "tx":
+        for _, txID := range payload.Items {
+            if !mempool.Has(txID) {
+                if err = sendGetData(payload.AddrFrom, "tx", txID); nil != err {
+                    break
+                }
+            }
+        }
+    }
+    if nil != err {
+        fmt.Println(err)
+    }
+}
+
+func handleGetData(request []byte, bc *BlockChain) {
+    var payload getdata
+    err := decodePayload(request, &payload)
+    if nil != err {
+        fmt.Println(err)
+        return
+    }
+
+    switch payload.Type {
+    case "block":
+        var b Block
+        if b, err = bc.GetBlock(payload.ID); nil == err {
+            err = sendBlock(payload.AddrFrom, &b)
+        }
+    case "tx":
+        if tnx, ok := mempool.Get(payload.ID); ok {
+            err = sendTx(payload.AddrFrom, &tnx)
+        }
+    }
+    if nil != err {
+        fmt.Println(err)
+    }
+}
+
+// 收到一个块，校验后入链，然后接着下载下一个还没拿到的块
+func handleBlock(request []byte, bc *BlockChain) {
+    var payload block
+    err := decodePayload(request, &payload)
+    if nil != err {
+        fmt.Println(err)
+        return
+    }
+
+    b, err := decodeBlock(payload.Block)
+    if nil != err {
+        fmt.Printf("Dropping a malformed block: %v\n", err)
+        return
+    }
+    fmt.Printf("Received a new block %x\n", b.Hash)
+
+    if err = bc.AddBlock(b); nil != err {
+        fmt.Println(err)
+        // 父块还没有的是孤块，重新要一份清单从缺的块开始补；其他校验失败的块记下来，以后不再下载
+        var blockErr *BlockError
+        syncLock.Lock()
+        orphan := errors.Is(err, ErrBadPrevBlock) && !bc.HasBlock(b.PrevBlockHash) &&
+            !rejectedBlocks[hex.EncodeToString(b.PrevBlockHash)]
+        if errors.As(err, &blockErr) && !orphan {
+            rejectedBlocks[hex.EncodeToString(b.Hash)] = true
+        }
+        blocksInTransit = nil // 剩下的块多半也接不上，按新的清单重新排
+        syncLock.Unlock()
+
+        if err = sendGetBlocks(payload.AddrFrom); nil != err {
+            fmt.Println(err)
+        }
+        return
+    }
+    fmt.Printf("Added block %x\n", b.Hash)
+    mempool.RemoveBlockTransactions(b)
+    mempool.Prune(&UTXOSet{bc}) // 可能发生了重组，连接上的其他块也会花掉池中交易的输入
+    restartMining(bc) // 正在挖的块已经过时了
+
+    syncLock.Lock()
+    var next []byte
+    for next == nil && len(blocksInTransit) > 0 {
+        if !bc.HasBlock(blocksInTransit[0]) { // 同一个块可能在几份清单里排了队
+            next = blocksInTransit[0]
+        }
+        blocksInTransit = blocksInTransit[1:]
+    }
+    syncLock.Unlock()
+
+    if next != nil {
+        if err = sendGetData(payload.AddrFrom, "block", next); nil != err {
+            fmt.Println(err)
+        }
+    }
+}
+
+// 收到一笔交易，校验通过后放入内存池并转告其他节点；矿工节点在内存池攒够交易后开始挖矿
+func handleTx(request []byte, bc *BlockChain) {
+    var payload tx
+    err := decodePayload(request, &payload)
+    if nil != err {
+        fmt.Println(err)
+        return
+    }
+
+    tnx, err := decodeTransaction(payload.Transaction)
+    if nil != err {
+        fmt.Printf("Dropping a malformed transaction: %v\n", err)
+        return
+    }
+    if err = mempool.Add(&tnx, &UTXOSet{bc}); nil != err {
+        fmt.Println(err)
+        return
+    }
+    fmt.Printf("Received transaction %x, %d in mempool\n", tnx.ID, mempool.Count())
+
+    for _, node := range getKnownNodes() {
+        if node != nodeAddress && node != payload.AddrFrom {
+            if err = sendInv(node, "tx", [][]byte{tnx.ID}); nil != err {
+                fmt.Println(err)
+            }
+        }
+    }
+
+    restartMining(bc)
+}
+
+// 内存池或 tip 变了：停掉正在挖的块，内存池里攒够交易时基于最新的 tip 和交易重新开始挖
+func restartMining(bc *BlockChain) {
+    if len(miningAddress) == 0 {
+        return
+    }
+
+    miningLock.Lock()
+    defer miningLock.Unlock()
+
+    if miningCancel != nil {
+        miningCancel()
+        miningCancel = nil
+    }
+    if mempool.Count() < mempoolThreshold {
+        return
+    }
+
+    ctx, cancel := context.WithCancel(context.Background())
+    miningCancel = cancel
+    go mineTransactions(ctx, bc)
+}
+
+// 用内存池里的交易挖一个新块，并把新块广播给其他节点
+func mineTransactions(ctx context.Context, bc *BlockChain) {
+    for _, tnx := range mempool.Transactions() {
+        if !bc.VerifyTransaction(tnx) {
+            mempool.Remove(tnx.ID)
+        }
+    }
+
+    // 手续费率高的交易优先打包，手续费全部归矿工
+    txs, fees := mempool.SelectTransactions(maxBlockTxsSize)
+    if len(txs) < mempoolThreshold {
+        return
+    }
+
+    newBlock, err := bc.MineBlockContext(ctx, miningAddress, fees, txs)
+    if err == context.Canceled {
+        fmt.Println("Mining is cancelled")
+        return
+    } else if nil != err {
+        fmt.Println(err)
+        return
+    }
+    mempool.RemoveBlockTransactions(newBlock)
+    fmt.Printf("New block %x is mined! Hash rate: %.0f H/s\n", newBlock.Hash, LastHashRate())
+
+    for _, node := range getKnownNodes() {
+        if node != nodeAddress {
+            if err := sendInv(node, "block", [][]byte{newBlock.Hash}); nil != err {
+                fmt.Println(err)
+            }
+        }
+    }
+
+    restartMining(bc) // 内存池里可能还有足够的交易
 }
 
 func nodeIsKnown(address string) bool {
+    knownNodesLock.Lock()
+    defer knownNodesLock.Unlock()
+
     for _, node := range knownNodes {
         if node == address {
             return true
@@ -191,27 +516,82 @@ func nodeIsKnown(address string) bool {
     return false
 }
 
+// 把未知的节点加入 knownNodes
+func addNodes(addresses ...string) {
+    knownNodesLock.Lock()
+    defer knownNodesLock.Unlock()
+
+Next:
+    for _, address := range addresses {
+        for _, node := range knownNodes {
+            if node == address {
+                continue Next
+            }
+        }
+        knownNodes = append(knownNodes, address)
+    }
+}
+
+// 把不可达的节点从 knownNodes 中移除。配置的种子节点暂时连不上也保留，以后还要靠它们同步
+func removeNode(address string) {
+    for _, seed := range ActiveChainParams().SeedNodes {
+        if seed == address {
+            return
+        }
+    }
+
+    knownNodesLock.Lock()
+    defer knownNodesLock.Unlock()
+
+    var updatedNodes []string
+    for _, node := range knownNodes {
+        if node != address {
+            updatedNodes = append(updatedNodes, node)
+        }
+    }
+    knownNodes = updatedNodes
+}
+
+// 中心节点是 knownNodes 的第一个，交易发给它广播
+func centralNode() (string, error) {
+    knownNodesLock.Lock()
+    defer knownNodesLock.Unlock()
+
+    if len(knownNodes) == 0 {
+        return "", errNoKnownNodes
+    }
+
+    return knownNodes[0], nil
+}
+
+// 返回 knownNodes 的快照，遍历时不会受到其他协程增删节点的影响
+func getKnownNodes() []string {
+    knownNodesLock.Lock()
+    defer knownNodesLock.Unlock()
+
+    nodes := make([]string, len(knownNodes))
+    copy(nodes, knownNodes)
+
+    return nodes
+}
+
 func handleAddr(request []byte) {
-    var (
-        buff bytes.Buffer
-        payload addr
-    )
-
-    buff.Write(request[commandLength:])
-    dec := gob.NewDecoder(&buff)
-    err := dec.Decode(&payload)
-    if err != nil {
-        panic(err)
+    var payload addr
+    if err := decodePayload(request, &payload); nil != err {
+        fmt.Println(err)
+        return
     }
 
-    knownNodes = append(knownNodes, payload.AddrList...)
-    fmt.Printf("There are %d known nodes now!\n", len(knownNodes))
+    addNodes(payload.AddrList...)
+    fmt.Printf("There are %d known nodes now!\n", len(getKnownNodes()))
     requestBlocks()
 }
 
 func requestBlocks() {
-    for _, node := range knownNodes {
-        sendGetBlocks(node)
+    for _, node := range getKnownNodes() {
+        if err := sendGetBlocks(node); nil != err {
+            fmt.Println(err)
+        }
     }
 }
 
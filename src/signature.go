@@ -0,0 +1,156 @@
+// @Title 签名
+// @Description ECDSA 签名：按 RFC 6979 由私钥和消息确定随机数，同一笔交易每次签出的结果都一样；s 取较小的那个，签名不能被改写。
+// secp256k1 的签名和验证用 dcrd 的实现，这里只处理旧版本的 P-256 密钥
+package src
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/hmac"
+	"crypto/sha256"
+	"math/big"
+
+	"github.com/decred/dcrd/dcrec/secp256k1/v4"
+	secpecdsa "github.com/decred/dcrd/dcrec/secp256k1/v4/ecdsa"
+)
+
+const signatureLen = 64 // r 和 s 各 32 字节
+
+// 签名是 r 和 s 各补齐到 32 字节后拼在一起
+func signHash(privKey ecdsa.PrivateKey, hash []byte) []byte {
+	signature := make([]byte, signatureLen)
+	if isLegacyKey(privKey.PublicKey) {
+		r, s := signRFC6979(&privKey, hash)
+		r.FillBytes(signature[:32])
+		s.FillBytes(signature[32:])
+		return signature
+	}
+
+	// dcrd 同样按 RFC 6979 取 k，并且已经把 s 换成了较小的那个
+	key := secp256k1.PrivKeyFromBytes(privKey.D.FillBytes(make([]byte, 32)))
+	defer key.Zero()
+	sig := secpecdsa.Sign(key, hash)
+	r, s := sig.R(), sig.S()
+	r.PutBytesUnchecked(signature[:32])
+	s.PutBytesUnchecked(signature[32:])
+
+	return signature
+}
+
+// 旧版本 P-256 密钥的确定性 ECDSA，kG 用标准库的 P-256 计算，运算时间与 k 无关。
+// r = (kG).x mod n，s = k⁻¹(e + r·d) mod n，k 由 rfc6979Nonces 生成。
+// (r, s) 和 (r, n-s) 都是有效签名，只用 s <= n/2 的那个
+func signRFC6979(privKey *ecdsa.PrivateKey, hash []byte) (*big.Int, *big.Int) {
+	curve := privKey.Curve
+	n := curve.Params().N
+	e := hashToInt(hash, n)
+	nextNonce := rfc6979Nonces(privKey.D, hash, n)
+
+	for {
+		k := nextNonce()
+		rx, _ := curve.ScalarBaseMult(k.Bytes())
+		r := new(big.Int).Mod(rx, n)
+		if r.Sign() == 0 {
+			continue
+		}
+		s := new(big.Int).Mul(r, privKey.D)
+		s.Add(s, e)
+		s.Mul(s, new(big.Int).ModInverse(k, n))
+		s.Mod(s, n)
+		if s.Sign() == 0 {
+			continue
+		}
+		if !isLowS(s, n) {
+			s.Sub(n, s)
+		}
+
+		return r, s
+	}
+}
+
+// rfc6979Nonces returns a generator of the nonces of RFC 6979 section 3.2 with HMAC-SHA256.
+// 每次调用返回下一个候选的 k，第一个不合适时（极少见）接着取
+func rfc6979Nonces(d *big.Int, hash []byte, n *big.Int) func() *big.Int {
+	qLen := (n.BitLen() + 7) / 8
+	x := d.FillBytes(make([]byte, qLen))
+	h1 := new(big.Int).Mod(hashToInt(hash, n), n).FillBytes(make([]byte, qLen))
+
+	mac := func(key []byte, data ...[]byte) []byte {
+		h := hmac.New(sha256.New, key)
+		for _, part := range data {
+			h.Write(part)
+		}
+		return h.Sum(nil)
+	}
+
+	v := bytes.Repeat([]byte{0x01}, sha256.Size)
+	k := make([]byte, sha256.Size)
+	k = mac(k, v, []byte{0x00}, x, h1)
+	v = mac(k, v)
+	k = mac(k, v, []byte{0x01}, x, h1)
+	v = mac(k, v)
+
+	first := true
+	return func() *big.Int {
+		for {
+			if !first {
+				k = mac(k, v, []byte{0x00})
+				v = mac(k, v)
+			}
+			first = false
+
+			var t []byte
+			for len(t) < qLen {
+				v = mac(k, v)
+				t = append(t, v...)
+			}
+			nonce := hashToInt(t, n)
+			if nonce.Sign() > 0 && nonce.Cmp(n) < 0 {
+				return nonce
+			}
+		}
+	}
+}
+
+// 取哈希的前 n 的位数那么多位作为整数（RFC 6979 的 bits2int）
+func hashToInt(hash []byte, n *big.Int) *big.Int {
+	orderBits := n.BitLen()
+	if len(hash) > (orderBits+7)/8 {
+		hash = hash[:(orderBits+7)/8]
+	}
+	e := new(big.Int).SetBytes(hash)
+	if excess := len(hash)*8 - orderBits; excess > 0 {
+		e.Rsh(e, uint(excess))
+	}
+
+	return e
+}
+
+// s 不超过 n/2
+func isLowS(s, n *big.Int) bool {
+	return s.Cmp(new(big.Int).Rsh(n, 1)) <= 0
+}
+
+// 验证 signHash 生成的签名，s 超过 n/2 的签名一律无效
+func verifySignature(pubKey ecdsa.PublicKey, hash, signature []byte) bool {
+	if len(signature) != signatureLen {
+		return false
+	}
+
+	if isLegacyKey(pubKey) {
+		r := new(big.Int).SetBytes(signature[:32])
+		s := new(big.Int).SetBytes(signature[32:])
+		return isLowS(s, pubKey.Curve.Params().N) && ecdsa.Verify(&pubKey, hash, r, s)
+	}
+
+	var r, s secp256k1.ModNScalar
+	if r.SetByteSlice(signature[:32]) || s.SetByteSlice(signature[32:]) || s.IsOverHalfOrder() {
+		return false // r 或 s 不小于 n
+	}
+	key, err := secp256k1.ParsePubKey(compressPoint(pubKey.X, pubKey.Y))
+	if nil != err {
+		return false
+	}
+
+	return secpecdsa.NewSignature(&r, &s).Verify(hash, key)
+}
@@ -1,26 +1,35 @@
 package src
 
 import (
+	"bytes"
 	"crypto/ecdsa"
-	"crypto/elliptic"
 	"crypto/rand"
 	"crypto/sha256"
+	"encoding/gob"
 	"encoding/hex"
 	"fmt"
-	"math/big"
 )
 
-const subsidy = 10 // 挖出新块的奖励金
+const (
+	lockTimeThreshold = 500000000  // 锁定时间小于它表示块高度，否则表示 Unix 时间戳
+	SequenceFinal     = 0xffffffff // 输入的序号都是它时，锁定时间不起作用
+)
 
 // 交易
 type Transaction struct {
-	ID   []byte
-	Vin  []TXInput  // 输入
-	Vout []TXOutput // 输出
+	ID       []byte
+	Vin      []TXInput  // 输入
+	Vout     []TXOutput // 输出
+	LockTime int64      // 在这个块高度或时间之后交易才能被打包，0 表示不锁定
+}
+
+// 创建一个 coinbase 交易，即"发行新币"，也就是给旷工奖励一些新币，奖励金的多少由块高度决定
+func CreateCoinBaseTX(to, data string, height int) *Transaction {
+	return CreateCoinBaseTXWithFees(to, data, height, 0)
 }
 
-// 创建一个 coinbase 交易，即"发行新币"，也就是给旷工奖励一个新币
-func CreateCoinBaseTX(to, data string) *Transaction {
+// 创建一个 coinbase 交易，矿工除了奖励金，还收取块中其他交易的手续费
+func CreateCoinBaseTXWithFees(to, data string, height, fees int) *Transaction {
 	if "" == data {
 		//data = fmt.Sprintf("Reward to '%s'", to)
 		randData := make([]byte, 20)
@@ -35,10 +44,10 @@ func CreateCoinBaseTX(to, data string) *Transaction {
 	txin := TXInput{
 		Txid:      []byte{},
 		Vout:      -1,
-		Signature: nil,
-		PubKey:    []byte(data),
+		ScriptSig: []byte(data),
+		Sequence:  SequenceFinal,
 	}
-	txout := NewTXOutput(subsidy, to)
+	txout := NewTXOutput(ActiveChainParams().BlockSubsidy(height)+fees, to) // 挖出新块的奖励金加手续费
 	tx := Transaction{
 		ID:   nil,
 		Vin:  []TXInput{txin},
@@ -49,7 +58,44 @@ func CreateCoinBaseTX(to, data string) *Transaction {
 	return &tx
 }
 
+// SetLockTime makes the transaction valid only in blocks after lockTime, a block height or a Unix timestamp.
+// 锁定时间是签名的内容，必须在签名之前设置，交易 ID 随之重新计算
+func (this *Transaction) SetLockTime(lockTime int64) {
+	this.LockTime = lockTime
+	for i := range this.Vin {
+		if this.Vin[i].Sequence == SequenceFinal {
+			this.Vin[i].Sequence = SequenceFinal - 1 // 让锁定时间生效
+		}
+	}
+	this.ID = this.unsignedHash()
+}
+
+// IsFinal reports whether the transaction can be included in a block at height with timestamp blockTime
+func (this *Transaction) IsFinal(height int, blockTime int64) bool {
+	if this.LockTime == 0 {
+		return true
+	}
+
+	limit := int64(height)
+	if this.LockTime >= lockTimeThreshold {
+		limit = blockTime
+	}
+	if this.LockTime < limit {
+		return true
+	}
+
+	// 所有输入的序号都是 SequenceFinal 时忽略锁定时间
+	for _, vin := range this.Vin {
+		if vin.Sequence != SequenceFinal {
+			return false
+		}
+	}
+
+	return true
+}
+
 // Sign signs each input of a Transaction
+// 目前只会花 P2PKH 输出：解锁脚本是 <签名> <公钥>
 func (this *Transaction) Sign(privKey ecdsa.PrivateKey, prevTXs map[string]Transaction) {
 	if this.IsCoinBase() {
 		return // coinbase 交易没有实际输入，所以不签名
@@ -61,43 +107,105 @@ func (this *Transaction) Sign(privKey ecdsa.PrivateKey, prevTXs map[string]Trans
 		}
 	}
 
-	txCopy := this.TrimmedCopy() // 对修剪后的交易副本签名，而不是对整个完整的交易签名
+	pubKey := encodePubKey(privKey.PublicKey)
+	for inID, vin := range this.Vin {
+		prevScript := prevTXs[hex.EncodeToString(vin.Txid)].Vout[vin.Vout].ScriptPubKey
+		if prevScript.PubKeyHash() == nil {
+			panic(fmt.Sprintf("ERROR: Cannot sign input %d, output script is %s", inID, prevScript))
+		}
 
-	for inID, vin := range txCopy.Vin {
-		prevTx := prevTXs[hex.EncodeToString(vin.Txid)]
-		txCopy.Vin[inID].Signature = nil
-		txCopy.Vin[inID].PubKey = prevTx.Vout[vin.Vout].PubKeyHash
+		signature := signHash(privKey, this.SignatureHash(inID, prevScript))
+		this.Vin[inID].ScriptSig = SignatureScript(signature, pubKey)
+	}
+}
 
-		dataToSign := fmt.Sprintf("%x\n", txCopy)
+// SignMultiSig adds the signature of privKey to every input spending a multisig (P2SH) output it is a key of,
+// and returns the number of inputs signed.
+// 解锁脚本是 <签名>... <赎回脚本>，签名按赎回脚本中公钥的顺序排列，凑够 m 个后不再添加
+func (this *Transaction) SignMultiSig(privKey ecdsa.PrivateKey, prevTXs map[string]Transaction) int {
+	pubKey := encodePubKey(privKey.PublicKey)
+	signed := 0
 
-		r, s, err := ecdsa.Sign(rand.Reader, &privKey, []byte(dataToSign))
-		if err != nil {
-			panic(err)
+	for inID, vin := range this.Vin {
+		prevTx, ok := prevTXs[hex.EncodeToString(vin.Txid)]
+		if !ok {
+			panic("ERROR: Previous transaction is not correct")
+		}
+		prevScript := prevTx.Vout[vin.Vout].ScriptPubKey
+		pushes := vin.ScriptSig.PushedData()
+		if prevScript.ScriptHash() == nil || len(pushes) == 0 {
+			continue
+		}
+		redeemScript := Script(pushes[len(pushes)-1])
+		if !bytes.Equal(redeemScript.Hash160(), prevScript.ScriptHash()) {
+			continue
+		}
+		m, pubKeys, err := ParseMultiSigScript(redeemScript)
+		if nil != err {
+			continue
 		}
-		signature := append(r.Bytes(), s.Bytes()...)
 
-		this.Vin[inID].Signature = signature
-		txCopy.Vin[inID].PubKey = nil
+		// 已有的签名对应到各自的公钥上
+		checker := &txSignatureChecker{this, inID, prevScript}
+		signatures := make([][]byte, len(pubKeys))
+		for _, signature := range pushes[:len(pushes)-1] {
+			for i := range pubKeys {
+				if signatures[i] == nil && checker.CheckSig(signature, pubKeys[i]) {
+					signatures[i] = signature
+					break
+				}
+			}
+		}
+		for i := range pubKeys {
+			if signatures[i] == nil && bytes.Equal(pubKeys[i], pubKey) {
+				signatures[i] = signHash(privKey, this.SignatureHash(inID, prevScript))
+				signed++
+			}
+		}
+
+		builder := NewScriptBuilder()
+		count := 0
+		for _, signature := range signatures {
+			if signature != nil && count < m {
+				builder.AddData(signature)
+				count++
+			}
+		}
+		this.Vin[inID].ScriptSig = builder.AddData(redeemScript).Script()
 	}
-}
 
-// 修剪后的交易副本
-// TrimmedCopy creates a trimmed copy of Transaction to be used in signing
-func (this *Transaction) TrimmedCopy() Transaction {
-	var inputs []TXInput
-	var outputs []TXOutput
+	return signed
+}
 
-	for _, vin := range this.Vin {
-		inputs = append(inputs, TXInput{vin.Txid, vin.Vout, nil, nil})
+// MultiSigProgress returns how many signatures a multisig input has and how many it needs.
+// 不是多重签名输入时都是 0
+func (this *TXInput) MultiSigProgress() (int, int) {
+	pushes := this.ScriptSig.PushedData()
+	if len(pushes) == 0 {
+		return 0, 0
 	}
-
-	for _, vout := range this.Vout {
-		outputs = append(outputs, TXOutput{vout.Value, vout.PubKeyHash})
+	m, _, err := ParseMultiSigScript(pushes[len(pushes)-1])
+	if nil != err {
+		return 0, 0
 	}
 
-	txCopy := Transaction{this.ID, inputs, outputs}
+	return len(pushes) - 1, m
+}
+
+// SignatureHash returns the hash signed for input inID.
+// 签名的是交易副本的哈希：所有输入的解锁脚本清空，被签名的输入换成它所花输出的锁定脚本
+func (this *Transaction) SignatureHash(inID int, prevScript Script) []byte {
+	txCopy := *this
+	txCopy.Vin = make([]TXInput, len(this.Vin))
+	for i, vin := range this.Vin {
+		vin.ScriptSig = nil
+		if i == inID {
+			vin.ScriptSig = prevScript
+		}
+		txCopy.Vin[i] = vin
+	}
 
-	return txCopy
+	return txCopy.Hash()
 }
 
 // Hash returns the hash of the Transaction
@@ -112,40 +220,92 @@ func (this *Transaction) Hash() []byte {
 	return hash[:]
 }
 
+// 交易 ID 是签名之前算出的哈希（见 NewUTXOTransaction），去掉解锁脚本后重新计算应该与 ID 一致
+func (this *Transaction) unsignedHash() []byte {
+	if this.IsCoinBase() {
+		return this.Hash() // coinbase 的解锁脚本是数据，不是签名
+	}
+
+	txCopy := *this
+	txCopy.Vin = make([]TXInput, len(this.Vin))
+	for i, vin := range this.Vin {
+		vin.ScriptSig = nil
+		txCopy.Vin[i] = vin
+	}
+
+	return txCopy.Hash()
+}
+
 // Verify verifies signatures of Transaction inputs
+// 对每个输入，依次执行它的解锁脚本和所花输出的锁定脚本
 func (this *Transaction) Verify(prevTXs map[string]Transaction) bool {
-	txCopy := this.TrimmedCopy() // 副本
-	curve := elliptic.P256()
-
 	for inID, vin := range this.Vin {
-		prevTx := prevTXs[hex.EncodeToString(vin.Txid)]
-		txCopy.Vin[inID].Signature = nil
-		txCopy.Vin[inID].PubKey = prevTx.Vout[vin.Vout].PubKeyHash
-
-		r := big.Int{}
-		s := big.Int{}
-		sigLen := len(vin.Signature)
-		r.SetBytes(vin.Signature[:(sigLen / 2)])
-		s.SetBytes(vin.Signature[(sigLen / 2):])
-
-		x := big.Int{}
-		y := big.Int{}
-		keyLen := len(vin.PubKey)
-		x.SetBytes(vin.PubKey[:(keyLen / 2)])
-		y.SetBytes(vin.PubKey[(keyLen / 2):])
-
-		dataToVerify := fmt.Sprintf("%x\n", txCopy)
-
-		rawPubKey := ecdsa.PublicKey{Curve: curve, X: &x, Y: &y}
-		if ecdsa.Verify(&rawPubKey, []byte(dataToVerify), &r, &s) == false {
+		prevTx, ok := prevTXs[hex.EncodeToString(vin.Txid)]
+		if !ok || vin.Vout < 0 || vin.Vout >= len(prevTx.Vout) {
+			return false
+		}
+
+		prevScript := prevTx.Vout[vin.Vout].ScriptPubKey
+		checker := &txSignatureChecker{this, inID, prevScript}
+		if err := ExecuteScript(vin.ScriptSig, prevScript, checker); nil != err {
 			return false
 		}
-		txCopy.Vin[inID].PubKey = nil
 	}
 
 	return true
 }
 
+// 在某个输入上执行脚本时，由它检查签名和锁定时间
+type txSignatureChecker struct {
+	tx         *Transaction
+	inID       int
+	prevScript Script
+}
+
+// 公钥是 33 字节的压缩格式，或旧钱包的 P-256 公钥（见 decodePubKey）
+func (this *txSignatureChecker) CheckSig(signature, pubKey []byte) bool {
+	rawPubKey, ok := decodePubKey(pubKey)
+	if !ok {
+		return false
+	}
+
+	return verifySignature(rawPubKey, this.tx.SignatureHash(this.inID, this.prevScript), signature)
+}
+
+// 脚本要求的锁定时间和交易的锁定时间必须同为高度或同为时间，且不晚于交易的锁定时间，
+// 输入的序号也不能是 SequenceFinal，否则交易的锁定时间不起作用
+func (this *txSignatureChecker) CheckLockTime(lockTime int64) bool {
+	txLockTime := this.tx.LockTime
+	if (lockTime < lockTimeThreshold) != (txLockTime < lockTimeThreshold) {
+		return false
+	}
+	if lockTime > txLockTime {
+		return false
+	}
+
+	return this.tx.Vin[this.inID].Sequence != SequenceFinal
+}
+
+// DeserializeTransaction deserializes a transaction
+func DeserializeTransaction(data []byte) Transaction {
+	transaction, err := decodeTransaction(data)
+	if nil != err {
+		panic(err)
+	}
+
+	return transaction
+}
+
+// 解码其他节点发来的交易，数据不对时返回错误而不是 panic
+func decodeTransaction(data []byte) (Transaction, error) {
+	var transaction Transaction
+
+	decoder := gob.NewDecoder(bytes.NewReader(data))
+	err := decoder.Decode(&transaction)
+
+	return transaction, err
+}
+
 func (this *Transaction) SetID() {
 	this.ID = this.Hash()
 }
@@ -157,11 +317,18 @@ func (this *Transaction) IsCoinBase() bool {
 
 func (this *Transaction) PrintTransaction() {
 	fmt.Printf("|----- transaction %v -----|\n", hex.EncodeToString(this.ID))
+	if this.LockTime != 0 {
+		fmt.Printf("|LockTime: %d|\n", this.LockTime)
+	}
 	for _, in := range this.Vin {
-		fmt.Printf("|Vin | PubKey: %s, Signature: %s, Txid: %s|\n", hex.EncodeToString(in.PubKey),
-			hex.EncodeToString(in.Signature), hex.EncodeToString(in.Txid))
+		if this.IsCoinBase() {
+			fmt.Printf("|Vin | CoinBase: %s|\n", hex.EncodeToString(in.ScriptSig))
+			continue
+		}
+		fmt.Printf("|Vin | Txid: %s, Vout: %d, ScriptSig: %s|\n", hex.EncodeToString(in.Txid), in.Vout,
+			in.ScriptSig)
 	}
 	for _, out := range this.Vout {
-		fmt.Printf("|Vout| Value: %d, PubKeyHash: %s|\n", out.Value, hex.EncodeToString(out.PubKeyHash))
+		fmt.Printf("|Vout| Value: %d, ScriptPubKey: %s|\n", out.Value, out.ScriptPubKey)
 	}
 }
@@ -8,37 +8,97 @@ import (
 	"github.com/boltdb/bolt"
 )
 
-const utxoBucket = "chainstate"
+const (
+	utxoBucket = "chainstate"
+	undoBucket = "undo" // 每个块花掉了哪些输出，回滚块时用来恢复 UTXO
+)
 
 // 交易输出
 type TXOutput struct {
-	Value int // 币值
-	//ScriptPubKey string // 锁定脚本
-	PubKeyHash []byte // 公钥的哈希值
+	Value        int    // 币值
+	ScriptPubKey Script // 锁定脚本，说明怎样才能花这个输出
 }
 
 // 交易输入
 type TXInput struct {
 	Txid      []byte // 之前交易的 ID
 	Vout      int
-	Signature []byte
-	PubKey    []byte
+	ScriptSig Script // 解锁脚本，提供签名和公钥等数据。coinbase 交易在这里放任意数据
+	Sequence  uint32 // 序号，不是 SequenceFinal 时交易的锁定时间才生效
 }
 
 type UTXOSet struct {
 	BlockChain *BlockChain
 }
 
-func NewUTXOTransaction(wallet *Wallet, to string, amount int, UTXOSet *UTXOSet) *Transaction {
-	var (
-		inputs  []TXInput
-		outputs []TXOutput
-	)
+// 创建一笔转账交易，输入比 amount 多出 fee，这部分差额留给打包交易的矿工
+func NewUTXOTransaction(wallet *Wallet, to string, amount, fee int, UTXOSet *UTXOSet) *Transaction {
+	from := fmt.Sprintf("%s", wallet.GetAddress())
+	tx := NewUnsignedTransaction(from, to, amount, fee, UTXOSet)
+	UTXOSet.BlockChain.SignTransaction(tx, wallet.PrivateKey)
+
+	return tx
+}
+
+// NewMultiSigTransaction creates a transaction spending outputs of the multisig address of redeemScript.
+// 交易还没有签名，每个输入的解锁脚本里先放好赎回脚本，密钥持有人依次用 SignMultiSig 补上签名
+func NewMultiSigTransaction(redeemScript Script, to string, amount, fee int, UTXOSet *UTXOSet) *Transaction {
+	if _, _, err := ParseMultiSigScript(redeemScript); nil != err {
+		panic(err)
+	}
+
+	from := string(ScriptHashAddress(redeemScript))
+	tx := NewUnsignedTransaction(from, to, amount, fee, UTXOSet)
+	for i := range tx.Vin {
+		tx.Vin[i].ScriptSig = NewScriptBuilder().AddData(redeemScript).Script()
+	}
+
+	return tx
+}
+
+// NewUnsignedTransaction creates a transaction paying amount from one address to another without signing it.
+// 从 from 地址的未花费输出中凑够 amount+fee，找零回到 from，ID 在签名之前算好
+func NewUnsignedTransaction(from, to string, amount, fee int, UTXOSet *UTXOSet) *Transaction {
+	if amount <= 0 || fee < 0 {
+		panic("ERROR: Amount must be positive and fee must not be negative")
+	}
 
-	pubKeyHash := HashPubKey(wallet.PublicKey)
-	acc, validOutputs := UTXOSet.FindSpendableOutputs(pubKeyHash, amount) // 找到所有的未花费输出
+	return newUnsignedTransaction(from, []TXOutput{*NewTXOutput(amount, to)}, fee, UTXOSet) // 接收者地址锁定
+}
 
-	if acc < amount {
+// NewNullDataTransaction creates an unsigned transaction that puts data on chain in an OP_RETURN output.
+// 数据输出的币值为 0，交易只花 from 的钱付手续费，其余找零
+func NewNullDataTransaction(from string, data []byte, fee int, UTXOSet *UTXOSet) *Transaction {
+	if len(data) > MaxNullDataSize {
+		panic(fmt.Sprintf("ERROR: Data must not be larger than %d bytes", MaxNullDataSize))
+	}
+	if fee < 0 {
+		panic("ERROR: Fee must not be negative")
+	}
+
+	return newUnsignedTransaction(from, []TXOutput{{0, NullDataScript(data)}}, fee, UTXOSet)
+}
+
+// 用 from 的未花费输出支付 outputs 和 fee。至少要有一个输入，否则交易 ID 不唯一
+func newUnsignedTransaction(from string, outputs []TXOutput, fee int, UTXOSet *UTXOSet) *Transaction {
+	var inputs []TXInput
+
+	amount := 0
+	for _, out := range outputs {
+		amount += out.Value
+	}
+	needed := amount + fee
+	if needed == 0 {
+		needed = 1
+	}
+
+	fromScript, err := AddressScript(from)
+	if nil != err {
+		panic(err)
+	}
+	acc, validOutputs := UTXOSet.FindSpendableScriptOutputs(fromScript, needed) // 找到所有的未花费输出
+
+	if acc < needed {
 		panic("ERROR: Not enough funds")
 	}
 
@@ -47,52 +107,43 @@ func NewUTXOTransaction(wallet *Wallet, to string, amount int, UTXOSet *UTXOSet)
 		txID, _ := hex.DecodeString(txid)
 
 		for _, out := range outs {
-			input := TXInput{txID, out, nil, wallet.PublicKey}
+			input := TXInput{txID, out, nil, SequenceFinal}
 			inputs = append(inputs, input)
 		}
 	}
 
-	// Build a list of outputs
-	from := fmt.Sprintf("%s", wallet.GetAddress())
-	outputs = append(outputs, *NewTXOutput(amount, to)) // 接收者地址锁定
-	if acc > amount {
-		outputs = append(outputs, *NewTXOutput(acc-amount, from)) // a change（找零）, 发送者地址锁定
+	if acc > amount+fee {
+		outputs = append(outputs, *NewTXOutput(acc-amount-fee, from)) // a change（找零）, 发送者地址锁定
 	}
 
-	tx := Transaction{nil, inputs, outputs}
+	tx := Transaction{nil, inputs, outputs, 0}
 	tx.SetID()
-	UTXOSet.BlockChain.SignTransaction(&tx, wallet.PrivateKey)
 
 	return &tx
 }
 
-// 输入解锁
-func (this *TXInput) CanUnlockOutputWith(unlockingData string) bool {
-	//return this.ScriptSig == unlockingData
-	return false
-}
-
-// 输出解锁
-func (this *TXOutput) CanBeUnlockedWith(unlockingData string) bool {
-	//return this.PubKeyHash == unlockingData
-	return false
-}
-
+// 解锁脚本的最后一项数据是花费者的公钥
 func (this *TXInput) UsesKey(pubKeyHash []byte) bool {
-	lockingHash := HashPubKey(this.PubKey)
+	pushes := this.ScriptSig.PushedData()
+	if len(pushes) == 0 {
+		return false
+	}
+	lockingHash := HashPubKey(pushes[len(pushes)-1])
 
 	return bytes.Compare(lockingHash, pubKeyHash) == 0
 }
 
+// 把输出锁定给地址，普通地址用 P2PKH 脚本，多重签名等脚本哈希地址用 P2SH 脚本
 func (this *TXOutput) Lock(address []byte) {
-	pubKeyHash := Base58Decode(address) // 先解码
-	// 去掉第1个字节（版本号）和最后4个字节（校验值），取中间的即公钥的哈希值
-	pubKeyHash = pubKeyHash[1 : len(pubKeyHash)-addressCheckSumLen]
-	this.PubKeyHash = pubKeyHash
+	script, err := AddressScript(string(address))
+	if nil != err {
+		panic(err)
+	}
+	this.ScriptPubKey = script
 }
 
 func (this *TXOutput) IsLockedWithKey(pubKeyHash []byte) bool {
-	return bytes.Compare(this.PubKeyHash, pubKeyHash) == 0
+	return bytes.Compare(this.ScriptPubKey.PubKeyHash(), pubKeyHash) == 0
 }
 
 // Serialize returns a serialized Transaction
@@ -109,10 +160,18 @@ func (this *Transaction) Serialize() []byte {
 }
 
 // FindSpendableOutputs finds and returns unspent outputs to reference in inputs
+// 还没成熟的 coinbase 输出不能花，不参与选择
 func (u UTXOSet) FindSpendableOutputs(pubkeyHash []byte, amount int) (int, map[string][]int) {
+	return u.FindSpendableScriptOutputs(PayToPubKeyHashScript(pubkeyHash), amount)
+}
+
+// FindSpendableScriptOutputs finds unspent outputs locked by scriptPubKey worth at least amount.
+// 内存池里的交易已经花掉的输出跳过，接连发出的交易不会花同一个输出，见 BlockChain.SetMempool
+func (u UTXOSet) FindSpendableScriptOutputs(scriptPubKey Script, amount int) (int, map[string][]int) {
 	unspentOutputs := make(map[string][]int)
 	accumulated := 0
 	db := u.BlockChain.db
+	spendHeight := u.BlockChain.GetBestHeight() + 1
 
 	err := db.View(func(tx *bolt.Tx) error {
 		b := tx.Bucket([]byte(utxoBucket))
@@ -121,9 +180,15 @@ func (u UTXOSet) FindSpendableOutputs(pubkeyHash []byte, amount int) (int, map[s
 		for k, v := c.First(); k != nil; k, v = c.Next() {
 			txID := hex.EncodeToString(k)
 			outs := DeserializeOutputs(v)
+			if !outs.IsMature(spendHeight) {
+				continue
+			}
 
 			for outIdx, out := range outs.Outputs {
-				if out.IsLockedWithKey(pubkeyHash) && accumulated < amount {
+				if pool := u.BlockChain.mempool; pool != nil && pool.IsSpent(k, outIdx) {
+					continue
+				}
+				if bytes.Equal(out.ScriptPubKey, scriptPubKey) && accumulated < amount {
 					accumulated += out.Value
 					unspentOutputs[txID] = append(unspentOutputs[txID], outIdx)
 				}
@@ -139,6 +204,42 @@ func (u UTXOSet) FindSpendableOutputs(pubkeyHash []byte, amount int) (int, map[s
 	return accumulated, unspentOutputs
 }
 
+// FindOutput returns the unspent output Vout of transaction txid
+func (this *UTXOSet) FindOutput(txid []byte, vout int) (TXOutput, bool) {
+	outs, found := this.FindOutputs(txid)
+	if !found {
+		return TXOutput{}, false
+	}
+	output, found := outs.Outputs[vout]
+
+	return output, found
+}
+
+// FindOutputs returns the unspent outputs of transaction txid, with the height and kind of the transaction
+func (this *UTXOSet) FindOutputs(txid []byte) (TXOutputs, bool) {
+	var (
+		outs  TXOutputs
+		found bool
+	)
+
+	err := this.BlockChain.db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(utxoBucket))
+		data := b.Get(txid)
+		if data == nil {
+			return nil
+		}
+
+		outs, found = DeserializeOutputs(data), true
+
+		return nil
+	})
+	if nil != err {
+		panic(err)
+	}
+
+	return outs, found
+}
+
 // NewTXOutput create a new TXOutput
 func NewTXOutput(value int, address string) *TXOutput {
 	txo := &TXOutput{value, nil}
@@ -147,8 +248,66 @@ func NewTXOutput(value int, address string) *TXOutput {
 	return txo
 }
 
+// 一笔交易中还没花掉的输出，key 是输出在交易中的序号（Vout）
 type TXOutputs struct {
-	Outputs []TXOutput
+	Outputs  map[int]TXOutput
+	Height   int  // 交易所在块的高度
+	CoinBase bool // 是否 coinbase 交易，coinbase 的输出要等成熟后才能花
+}
+
+// NewTXOutputs collects all spendable outputs of a transaction included in the block at height
+func NewTXOutputs(tx *Transaction, height int) TXOutputs {
+	outs := TXOutputs{make(map[int]TXOutput), height, tx.IsCoinBase()}
+	for outIdx, out := range tx.Vout {
+		if out.ScriptPubKey.IsUnspendable() {
+			continue // 永远花不掉的输出不放进 UTXO 集
+		}
+		outs.Outputs[outIdx] = out
+	}
+
+	return outs
+}
+
+// IsMature reports whether the outputs can be spent by a transaction in the block at spendHeight.
+// coinbase 的输出要在后面再有 CoinbaseMaturity 个块之后才能花，以免重组时已经花掉的奖励失效
+func (this *TXOutputs) IsMature(spendHeight int) bool {
+	return !this.CoinBase || spendHeight-this.Height >= ActiveChainParams().CoinbaseMaturity
+}
+
+// 被块中的交易花掉的一个输出
+type SpentOutput struct {
+	Txid     []byte
+	Vout     int
+	Output   TXOutput
+	Height   int // 被花掉的输出所在交易的高度和类型，回滚时原样恢复
+	CoinBase bool
+}
+
+// 回滚一个块所需的数据，按花费的先后顺序记录
+type BlockUndo struct {
+	SpentOutputs []SpentOutput
+}
+
+func (this *BlockUndo) Serialize() []byte {
+	var buff bytes.Buffer
+
+	enc := gob.NewEncoder(&buff)
+	if err := enc.Encode(this); nil != err {
+		panic(err)
+	}
+
+	return buff.Bytes()
+}
+
+func DeserializeBlockUndo(data []byte) BlockUndo {
+	var undo BlockUndo
+
+	dec := gob.NewDecoder(bytes.NewReader(data))
+	if err := dec.Decode(&undo); nil != err {
+		panic(err)
+	}
+
+	return undo
 }
 
 // serializes TXOutputs
@@ -178,48 +337,45 @@ func DeserializeOutputs(data []byte) TXOutputs {
 }
 
 // rebuilds the UTXO set
+// 清空 chainstate 后从创世块开始按顺序重放主链上的块，顺带重建每个块的回滚数据
 func (this *UTXOSet) ReIndex() {
 	db := this.BlockChain.db
-	bucketName := []byte(utxoBucket)
+	bestHeight := this.BlockChain.GetBestHeight()
 
 	err := db.Update(func(tx *bolt.Tx) error {
-		if err := tx.DeleteBucket(bucketName); nil != err && err != bolt.ErrBucketNotFound {
-			panic(err)
-		}
-
-		if _, err := tx.CreateBucket(bucketName); nil != err {
-			panic(err)
-		}
-
-		return nil
-	})
-	if nil != err {
-		panic(err)
-	}
-
-	utxo := this.BlockChain.FindUTXO()
-
-	err = db.Update(func(tx *bolt.Tx) error {
-		b := tx.Bucket(bucketName)
-
-		for txID, outs := range utxo {
-			key, err := hex.DecodeString(txID)
-			if nil != err {
+		for _, name := range [][]byte{[]byte(utxoBucket), []byte(undoBucket)} {
+			if err := tx.DeleteBucket(name); nil != err && err != bolt.ErrBucketNotFound {
 				panic(err)
 			}
 
-			err = b.Put(key, outs.Serialize())
-			if nil != err {
+			if _, err := tx.CreateBucket(name); nil != err {
 				panic(err)
 			}
 		}
 
+		blocks := tx.Bucket([]byte(blocksBucket))
+		heights := tx.Bucket([]byte(heightsBucket))
+		for height := 0; height <= bestHeight; height++ {
+			block := DeserializeBlock(blocks.Get(heights.Get(IntToHex(int64(height)))))
+			if err := connectBlockUTXO(tx, block); nil != err {
+				return err
+			}
+		}
+
 		return nil
 	})
+	if nil != err {
+		panic(err)
+	}
 }
 
 // finds UTXO for a public key hash
 func (this *UTXOSet) FindUTXO(pubKeyHash []byte) []TXOutput {
+	return this.FindScriptUTXO(PayToPubKeyHashScript(pubKeyHash))
+}
+
+// FindScriptUTXO finds UTXO locked by scriptPubKey
+func (this *UTXOSet) FindScriptUTXO(scriptPubKey Script) []TXOutput {
 	var utxos []TXOutput
 	db := this.BlockChain.db
 
@@ -231,7 +387,7 @@ func (this *UTXOSet) FindUTXO(pubKeyHash []byte) []TXOutput {
 			outs := DeserializeOutputs(v)
 
 			for _, out := range outs.Outputs {
-				if out.IsLockedWithKey(pubKeyHash) {
+				if bytes.Equal(out.ScriptPubKey, scriptPubKey) {
 					utxos = append(utxos, out)
 				}
 			}
@@ -248,17 +404,127 @@ func (this *UTXOSet) FindUTXO(pubKeyHash []byte) []TXOutput {
 
 // updates the UTXO set with transactions from the Block
 // The Block is considered to be the tip of a blockchain
+// BlockChain.AddBlock and BlockChain.MineBlock already do this when they connect a block, and reorganizations
+// revert the blocks they disconnect, call it only for a block that reached the chain some other way
 func (this *UTXOSet) Update(block *Block) {
 	db := this.BlockChain.db
 
 	err := db.Update(func(tx *bolt.Tx) error {
-		return nil
+		return connectBlockUTXO(tx, block)
 	})
 	if nil != err {
 		panic(err)
 	}
 }
 
+// Revert undoes Update: removes the outputs created by the Block and restores the outputs it spent
+// The Block is considered to be the tip of the chainstate
+func (this *UTXOSet) Revert(block *Block) {
+	db := this.BlockChain.db
+
+	err := db.Update(func(tx *bolt.Tx) error {
+		return disconnectBlockUTXO(tx, block)
+	})
+	if nil != err {
+		panic(err)
+	}
+}
+
+// 在 chainstate 中应用一个块：删掉块中非 coinbase 输入花掉的输出，加入每笔交易的新输出，并记录回滚数据
+func connectBlockUTXO(tx *bolt.Tx, block *Block) error {
+	b, err := tx.CreateBucketIfNotExists([]byte(utxoBucket))
+	if nil != err {
+		return err
+	}
+	undo := BlockUndo{}
+
+	for _, tnx := range block.Transcations {
+		if tnx.IsCoinBase() == false {
+			for _, vin := range tnx.Vin {
+				data := b.Get(vin.Txid)
+				if data == nil {
+					return fmt.Errorf("block %x: output %x:%d is not in the UTXO set", block.Hash, vin.Txid, vin.Vout)
+				}
+
+				outs := DeserializeOutputs(data)
+				out, ok := outs.Outputs[vin.Vout]
+				if !ok {
+					return fmt.Errorf("block %x: output %x:%d is not in the UTXO set", block.Hash, vin.Txid, vin.Vout)
+				}
+				undo.SpentOutputs = append(undo.SpentOutputs,
+					SpentOutput{vin.Txid, vin.Vout, out, outs.Height, outs.CoinBase})
+
+				delete(outs.Outputs, vin.Vout)
+				if err := putOutputs(b, vin.Txid, outs); nil != err {
+					return err
+				}
+			}
+		}
+
+		if err := putOutputs(b, tnx.ID, NewTXOutputs(tnx, block.Height)); nil != err {
+			return err
+		}
+	}
+
+	undoB, err := tx.CreateBucketIfNotExists([]byte(undoBucket))
+	if nil != err {
+		return err
+	}
+
+	return undoB.Put(block.Hash, undo.Serialize())
+}
+
+// 在 chainstate 中撤销一个块：倒序删掉块中交易的输出，再把它们花掉的输出放回去
+func disconnectBlockUTXO(tx *bolt.Tx, block *Block) error {
+	b := tx.Bucket([]byte(utxoBucket))
+	undoB := tx.Bucket([]byte(undoBucket))
+
+	var undoData []byte
+	if undoB != nil {
+		undoData = undoB.Get(block.Hash)
+	}
+	if undoData == nil {
+		return fmt.Errorf("block %x: no undo data", block.Hash)
+	}
+	undo := DeserializeBlockUndo(undoData)
+	spent := undo.SpentOutputs
+
+	for i := len(block.Transcations) - 1; i >= 0; i-- {
+		tnx := block.Transcations[i]
+		if err := b.Delete(tnx.ID); nil != err {
+			return err
+		}
+
+		if tnx.IsCoinBase() {
+			continue
+		}
+		for j := len(tnx.Vin) - 1; j >= 0; j-- {
+			restore := spent[len(spent)-1]
+			spent = spent[:len(spent)-1]
+
+			outs := TXOutputs{make(map[int]TXOutput), restore.Height, restore.CoinBase}
+			if data := b.Get(restore.Txid); data != nil {
+				outs = DeserializeOutputs(data)
+			}
+			outs.Outputs[restore.Vout] = restore.Output
+			if err := putOutputs(b, restore.Txid, outs); nil != err {
+				return err
+			}
+		}
+	}
+
+	return undoB.Delete(block.Hash)
+}
+
+// 保存一笔交易剩下的未花费输出，全部花完时删掉这条记录
+func putOutputs(b *bolt.Bucket, txID []byte, outs TXOutputs) error {
+	if len(outs.Outputs) == 0 {
+		return b.Delete(txID)
+	}
+
+	return b.Put(txID, outs.Serialize())
+}
+
 // CountTransactions returns the number of transactions in the UTXO set
 func (this *UTXOSet) CountTransactions() int {
 	db := this.BlockChain.db
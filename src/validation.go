@@ -0,0 +1,285 @@
+// @Title 区块校验
+// @Description 共识规则：收到或挖出的块必须全部通过这些检查才能连接到主链
+package src
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/boltdb/bolt"
+)
+
+const (
+	medianTimeSpan     = 11            // 取前多少个块的时间戳中位数
+	maxFutureBlockTime = 2 * time.Hour // 块的时间戳最多比本地时间超前多少
+)
+
+// 每条共识规则对应一个错误，用 errors.Is 判断块违反了哪一条
+var (
+	ErrBadProofOfWork  = errors.New("proof of work is invalid")
+	ErrBadDifficulty   = errors.New("difficulty bits are not the expected ones")
+	ErrBadPrevBlock    = errors.New("previous block is unknown or height does not follow it")
+	ErrBadTimestamp    = errors.New("timestamp is out of range")
+	ErrBadCoinBase     = errors.New("coinbase is missing, misplaced or duplicated")
+	ErrBadCoinBaseVal  = errors.New("coinbase pays more than subsidy plus fees")
+	ErrBadMerkleRoot   = errors.New("transactions do not match the header")
+	ErrDoubleSpend     = errors.New("output is spent twice in the block")
+	ErrMissingInput    = errors.New("input refers to an output that is spent or does not exist")
+	ErrImmatureSpend   = errors.New("input spends a coinbase output that is not mature yet")
+	ErrNonFinalTx      = errors.New("transaction lock time is not reached")
+	ErrBadNullData     = errors.New("data output is malformed or carries too much data")
+	ErrBadSignature    = errors.New("input signature is invalid")
+	ErrOutputsExceedIn = errors.New("outputs are worth more than inputs")
+	ErrBadValue        = errors.New("value is negative or more than the supply cap")
+	ErrNoInputs        = errors.New("transaction has no inputs")
+)
+
+// 块校验失败的原因
+type BlockError struct {
+	Hash   []byte
+	Rule   error  // 上面的某个 Err* 变量
+	Detail string // 具体是哪笔交易、哪个输出出了问题
+}
+
+func (this *BlockError) Error() string {
+	if this.Detail == "" {
+		return fmt.Sprintf("block %x: %v", this.Hash, this.Rule)
+	}
+
+	return fmt.Sprintf("block %x: %v: %s", this.Hash, this.Rule, this.Detail)
+}
+
+func (this *BlockError) Unwrap() error {
+	return this.Rule
+}
+
+func blockError(block *Block, rule error, format string, args ...interface{}) error {
+	return &BlockError{block.Hash, rule, fmt.Sprintf(format, args...)}
+}
+
+// ValidateBlock checks every consensus rule for a block that is going to extend the current tip
+func (this *BlockChain) ValidateBlock(block *Block) error {
+	if err := checkBlock(block); nil != err {
+		return err
+	}
+
+	return this.db.View(func(tx *bolt.Tx) error {
+		if err := checkBlockHeader(tx, block); nil != err {
+			return err
+		}
+		if tip := tx.Bucket([]byte(blocksBucket)).Get([]byte("l")); !bytes.Equal(block.PrevBlockHash, tip) {
+			return blockError(block, ErrBadPrevBlock, "previous block %x is not the tip", block.PrevBlockHash)
+		}
+
+		return checkBlockTransactions(tx, block)
+	})
+}
+
+// 与链无关的检查：难度不低于下限、工作量证明、默克尔根和交易 ID、coinbase 的数量和位置、交易的锁定时间、输出金额、
+// 数据输出的大小、普通交易有输入、块内是否重复花费
+func checkBlock(block *Block) error {
+	pow := NewProofOfWork(block)
+	if pow.target.Sign() <= 0 || pow.target.Cmp(ActiveChainParams().powLimit()) > 0 {
+		return blockError(block, ErrBadDifficulty, "target %x is out of range", pow.target)
+	}
+	hash := sha256.Sum256(pow.prepareData(block.Nonce))
+	if !pow.Validate() || !bytes.Equal(hash[:], block.Hash) {
+		return blockError(block, ErrBadProofOfWork, "")
+	}
+
+	if len(block.Transcations) == 0 || !block.Transcations[0].IsCoinBase() {
+		return blockError(block, ErrBadCoinBase, "first transaction is not a coinbase")
+	}
+
+	if !bytes.Equal(block.MerkleRoot, block.HashTranscations()) {
+		return blockError(block, ErrBadMerkleRoot, "merkle root %x", block.MerkleRoot)
+	}
+
+	spent := make(map[string]bool)
+	for i, tx := range block.Transcations {
+		if !bytes.Equal(tx.ID, tx.unsignedHash()) {
+			return blockError(block, ErrBadMerkleRoot, "transaction %x has a wrong ID", tx.ID)
+		}
+		if i > 0 && tx.IsCoinBase() {
+			return blockError(block, ErrBadCoinBase, "transaction %x is a second coinbase", tx.ID)
+		}
+		if !tx.IsFinal(block.Height, block.Timestamp) {
+			return blockError(block, ErrNonFinalTx, "transaction %x is locked until %d", tx.ID, tx.LockTime)
+		}
+		if _, err := sumOutputs(tx); nil != err {
+			return blockError(block, ErrBadValue, "%v", err)
+		}
+		for outIdx, out := range tx.Vout {
+			if out.ScriptPubKey.isBadNullData() {
+				return blockError(block, ErrBadNullData, "output %s", outpointKey(tx.ID, outIdx))
+			}
+		}
+		if tx.IsCoinBase() {
+			continue
+		}
+		if len(tx.Vin) == 0 {
+			return blockError(block, ErrNoInputs, "transaction %x", tx.ID)
+		}
+
+		for _, vin := range tx.Vin {
+			key := outpointKey(vin.Txid, vin.Vout)
+			if spent[key] {
+				return blockError(block, ErrDoubleSpend, "output %s", key)
+			}
+			spent[key] = true
+		}
+	}
+
+	return nil
+}
+
+// 与父块相关的检查：父块存在、高度连续、难度符合调整规则、时间戳不早于前 11 个块的中位数，也不超前本地时间太多
+func checkBlockHeader(tx *bolt.Tx, block *Block) error {
+	b := tx.Bucket([]byte(blocksBucket))
+
+	prevBlockData := b.Get(block.PrevBlockHash)
+	if prevBlockData == nil {
+		return blockError(block, ErrBadPrevBlock, "previous block %x not found", block.PrevBlockHash)
+	}
+	prevBlock := DeserializeBlock(prevBlockData)
+	if block.Height != prevBlock.Height+1 {
+		return blockError(block, ErrBadPrevBlock, "height %d does not follow previous block height %d",
+			block.Height, prevBlock.Height)
+	}
+
+	if expected := nextBits(tx, prevBlock); block.Bits != expected {
+		return blockError(block, ErrBadDifficulty, "bits %08x, expected %08x", block.Bits, expected)
+	}
+
+	if medianTime := medianTimePast(tx, prevBlock); block.Timestamp < medianTime {
+		return blockError(block, ErrBadTimestamp, "%d is before median time %d", block.Timestamp, medianTime)
+	}
+	if maxTime := time.Now().Add(maxFutureBlockTime).Unix(); block.Timestamp > maxTime {
+		return blockError(block, ErrBadTimestamp, "%d is too far in the future", block.Timestamp)
+	}
+
+	return nil
+}
+
+// 以 block 结尾的前 11 个块的时间戳中位数
+func medianTimePast(tx *bolt.Tx, block *Block) int64 {
+	b := tx.Bucket([]byte(blocksBucket))
+	var timestamps []int64
+
+	for {
+		timestamps = append(timestamps, block.Timestamp)
+		if len(timestamps) == medianTimeSpan || len(block.PrevBlockHash) == 0 {
+			break
+		}
+		block = DeserializeBlock(b.Get(block.PrevBlockHash))
+	}
+	sort.Slice(timestamps, func(i, j int) bool { return timestamps[i] < timestamps[j] })
+
+	return timestamps[len(timestamps)/2]
+}
+
+// 对照 chainstate 检查块中的交易：输入都是未花费的输出，签名正确，输入不少于输出，coinbase 不超过该高度的奖励加手续费。
+// chainstate 必须正好停在块的父块上
+func checkBlockTransactions(tx *bolt.Tx, block *Block) error {
+	utxo := tx.Bucket([]byte(utxoBucket))
+	created := make(map[string]TXOutput) // 块中前面的交易产生的输出，后面的交易可以花
+	fees := 0
+
+	for _, tnx := range block.Transcations[1:] {
+		prevTXs := make(map[string]Transaction)
+		inputValue := 0
+
+		for _, vin := range tnx.Vin {
+			key := outpointKey(vin.Txid, vin.Vout)
+			out, ok := created[key]
+			if ok {
+				delete(created, key)
+			} else if utxo != nil {
+				if data := utxo.Get(vin.Txid); data != nil {
+					outs := DeserializeOutputs(data)
+					if out, ok = outs.Outputs[vin.Vout]; ok && !outs.IsMature(block.Height) {
+						return blockError(block, ErrImmatureSpend, "transaction %x spends %s from height %d",
+							tnx.ID, key, outs.Height)
+					}
+				}
+			}
+			if !ok {
+				return blockError(block, ErrMissingInput, "transaction %x spends %s", tnx.ID, key)
+			}
+
+			inputValue += out.Value
+			if !validMoney(inputValue) {
+				return blockError(block, ErrBadValue, "inputs of transaction %x are worth more than %d",
+					tnx.ID, ActiveChainParams().MaxSupply)
+			}
+			addPrevOutput(prevTXs, vin.Txid, vin.Vout, out)
+		}
+
+		if !tnx.Verify(prevTXs) {
+			return blockError(block, ErrBadSignature, "transaction %x", tnx.ID)
+		}
+
+		outputValue, err := sumOutputs(tnx)
+		if nil != err {
+			return blockError(block, ErrBadValue, "%v", err)
+		}
+		for outIdx, out := range tnx.Vout {
+			created[outpointKey(tnx.ID, outIdx)] = out
+		}
+		if outputValue > inputValue {
+			return blockError(block, ErrOutputsExceedIn, "transaction %x spends %d but has only %d",
+				tnx.ID, outputValue, inputValue)
+		}
+		fees += inputValue - outputValue
+		if !validMoney(fees) {
+			return blockError(block, ErrBadValue, "fees are more than %d", ActiveChainParams().MaxSupply)
+		}
+	}
+
+	coinBaseValue, err := sumOutputs(block.Transcations[0])
+	if nil != err {
+		return blockError(block, ErrBadValue, "%v", err)
+	}
+	if allowed := ActiveChainParams().BlockSubsidy(block.Height) + fees; coinBaseValue > allowed {
+		return blockError(block, ErrBadCoinBaseVal, "pays %d, allowed %d", coinBaseValue, allowed)
+	}
+
+	return nil
+}
+
+// 金额必须在 0 到 MaxSupply 之间。累加金额时每加一次都检查，和就不会溢出
+func validMoney(value int) bool {
+	return value >= 0 && value <= ActiveChainParams().MaxSupply
+}
+
+// 检查交易的每个输出和输出总额都是合法金额，返回输出总额
+func sumOutputs(tx *Transaction) (int, error) {
+	total := 0
+	for outIdx, out := range tx.Vout {
+		if !validMoney(out.Value) {
+			return 0, fmt.Errorf("output %s is worth %d", outpointKey(tx.ID, outIdx), out.Value)
+		}
+		total += out.Value
+		if !validMoney(total) {
+			return 0, fmt.Errorf("outputs of transaction %x are worth more than %d", tx.ID, ActiveChainParams().MaxSupply)
+		}
+	}
+
+	return total, nil
+}
+
+// Transaction.Verify 需要前序交易，这里只知道被花的输出，就造一个只在对应位置有这个输出的交易
+func addPrevOutput(prevTXs map[string]Transaction, txid []byte, vout int, out TXOutput) {
+	key := fmt.Sprintf("%x", txid)
+	prevTx := prevTXs[key]
+	prevTx.ID = txid
+	for len(prevTx.Vout) <= vout {
+		prevTx.Vout = append(prevTx.Vout, TXOutput{})
+	}
+	prevTx.Vout[vout] = out
+	prevTXs[key] = prevTx
+}
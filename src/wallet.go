@@ -4,13 +4,15 @@ import (
 	"bytes"
 	"crypto/ecdsa"
 	"crypto/elliptic"
-	"crypto/rand"
 	"crypto/sha256"
+	"fmt"
+	"math/big"
+
+	"github.com/decred/dcrd/dcrec/secp256k1/v4"
 	"golang.org/x/crypto/ripemd160"
 )
 
 const (
-	version1           = byte(0x00)
 	addressCheckSumLen = 4
 )
 
@@ -29,24 +31,116 @@ func NewWallet() *Wallet {
 	return &wallet
 }
 
+// 钱包密钥和签名用的椭圆曲线。旧版本用的是 P-256，那些密钥仍然可以花费，见 newLegacyWalletFromKey
+func keyCurve() elliptic.Curve {
+	return secp256k1.S256()
+}
+
 // 生成密钥对
 func newKeyPair() (ecdsa.PrivateKey, []byte) {
-	curve := elliptic.P256()
-	private, err := ecdsa.GenerateKey(curve, rand.Reader) // 私钥
+	key, err := secp256k1.GeneratePrivateKey()
 	if nil != err {
 		panic(err)
 	}
-	pubKey := append(private.PublicKey.X.Bytes(), private.PublicKey.Y.Bytes()...) // 公钥
+	wallet := NewWalletFromKey(key.Serialize())
+
+	return wallet.PrivateKey, wallet.PublicKey
+}
 
-	return *private, pubKey
+// NewWalletFromKey restores the wallet of a secp256k1 private key, given as a big-endian integer
+func NewWalletFromKey(d []byte) *Wallet {
+	return walletFromKey(keyCurve(), d)
+}
+
+// 由旧版本的 P-256 私钥恢复钱包，公钥仍按旧格式编码，地址不变
+func newLegacyWalletFromKey(d []byte) *Wallet {
+	return walletFromKey(elliptic.P256(), d)
+}
+
+func walletFromKey(curve elliptic.Curve, d []byte) *Wallet {
+	private := ecdsa.PrivateKey{D: new(big.Int).SetBytes(d)}
+	private.PublicKey.Curve = curve
+	private.PublicKey.X, private.PublicKey.Y = scalarBaseMult(curve, d)
+
+	return &Wallet{private, encodePubKey(private.PublicKey)}
+}
+
+// 由私钥计算公钥点 dG。d 是秘密，运算时间不能随 d 变化：secp256k1 交给 dcrd 的实现，P-256 用标准库
+func scalarBaseMult(curve elliptic.Curve, d []byte) (*big.Int, *big.Int) {
+	if curve.Params().Name == elliptic.P256().Params().Name {
+		return curve.ScalarBaseMult(d)
+	}
+	pubKey := secp256k1.PrivKeyFromBytes(d).PubKey()
+
+	return pubKey.X(), pubKey.Y()
+}
+
+// isLegacyKey reports whether the key is a P-256 key of an older wallet
+func isLegacyKey(pubKey ecdsa.PublicKey) bool {
+	return pubKey.Curve.Params().Name == elliptic.P256().Params().Name
+}
+
+// 公钥编码成 33 字节的压缩格式：0x02 或 0x03 加上 X。
+// 旧的 P-256 公钥是 X 和 Y 直接拼在一起，开头的 0 字节会被去掉，长度不固定
+func encodePubKey(pubKey ecdsa.PublicKey) []byte {
+	if isLegacyKey(pubKey) {
+		return append(pubKey.X.Bytes(), pubKey.Y.Bytes()...)
+	}
+
+	return compressPoint(pubKey.X, pubKey.Y)
+}
+
+// 解析 encodePubKey 编码的公钥。旧格式的 X 和 Y 长度不定，逐个试分割点，落在 P-256 上的就是
+func decodePubKey(pubKey []byte) (ecdsa.PublicKey, bool) {
+	if len(pubKey) == 33 && (pubKey[0] == 2 || pubKey[0] == 3) {
+		key, err := secp256k1.ParsePubKey(pubKey)
+		if nil != err {
+			return ecdsa.PublicKey{}, false
+		}
+		return *key.ToECDSA(), true
+	}
+
+	curve := elliptic.P256()
+	if len(pubKey) > 64 || len(pubKey) < 2 {
+		return ecdsa.PublicKey{}, false
+	}
+	splits := []int{len(pubKey) / 2}
+	for xLen := len(pubKey) - 32; xLen <= 32; xLen++ {
+		if xLen > 0 && xLen != len(pubKey)/2 {
+			splits = append(splits, xLen)
+		}
+	}
+	for _, xLen := range splits {
+		x := new(big.Int).SetBytes(pubKey[:xLen])
+		y := new(big.Int).SetBytes(pubKey[xLen:])
+		if curve.IsOnCurve(x, y) {
+			return ecdsa.PublicKey{Curve: curve, X: x, Y: y}, true
+		}
+	}
+
+	return ecdsa.PublicKey{}, false
+}
+
+// Sign signs a 32 byte hash, the same hash and key always give the same 64 byte signature
+func (this *Wallet) Sign(hash []byte) []byte {
+	return signHash(this.PrivateKey, hash)
 }
 
 // 生成钱包地址
 func (this *Wallet) GetAddress() []byte {
 	pubKeyHash := HashPubKey(this.PublicKey)
 
-	versionedPayload := append([]byte{version1}, pubKeyHash...) // (version + pubKeyHash)
-	checksum := checkSum(versionedPayload)                      // 计算出 (版本+公钥) 的校验和
+	return encodeAddress(ActiveChainParams().AddressVersion, pubKeyHash) // 版本字节随网络不同
+}
+
+// ScriptHashAddress returns the P2SH address of a redeem script, e.g. a multisig script
+func ScriptHashAddress(redeemScript Script) []byte {
+	return encodeAddress(ActiveChainParams().ScriptHashVersion, redeemScript.Hash160())
+}
+
+func encodeAddress(version byte, hash []byte) []byte {
+	versionedPayload := append([]byte{version}, hash...) // (version + pubKeyHash)
+	checksum := checkSum(versionedPayload)               // 计算出 (版本+公钥) 的校验和
 
 	fullPayload := append(versionedPayload, checksum...) // 把校验和追加到尾部 (version + pubKeyHash + checksum)
 	address := Base58Encode(fullPayload)                 // 上面三个组合，经过base58编码之后，就生成了地址
@@ -54,6 +148,21 @@ func (this *Wallet) GetAddress() []byte {
 	return address
 }
 
+// AddressScript returns the locking script paying to address: P2PKH or P2SH depending on its version byte
+func AddressScript(address string) (Script, error) {
+	if !ValidateAddress(address) {
+		return nil, fmt.Errorf("address %s is not valid", address)
+	}
+	payload := Base58Decode([]byte(address))
+	hash := payload[1 : len(payload)-addressCheckSumLen]
+
+	if payload[0] == ActiveChainParams().ScriptHashVersion {
+		return PayToScriptHashScript(hash), nil
+	}
+
+	return PayToPubKeyHashScript(hash), nil
+}
+
 // 计算公钥的哈希值
 func HashPubKey(pubKey []byte) []byte {
 	// 使用 RIPEMD160(SHA256(PubKey)) 方法，进行两次哈希。一次是SHA256，一次是RIPEMD160。
@@ -70,10 +179,20 @@ func HashPubKey(pubKey []byte) []byte {
 }
 
 // check if address is valid
+// 校验和正确，且版本字节是当前网络的公钥哈希地址或脚本哈希地址
 func ValidateAddress(address string) bool {
+	if len(address) == 0 {
+		return false
+	}
 	pubKeyHash := Base58Decode([]byte(address))
+	if len(pubKeyHash) <= addressCheckSumLen {
+		return false
+	}
 	actualCheckSum := pubKeyHash[len(pubKeyHash)-addressCheckSumLen:]
 	version := pubKeyHash[0]
+	if params := ActiveChainParams(); version != params.AddressVersion && version != params.ScriptHashVersion {
+		return false
+	}
 	pubKeyHash = pubKeyHash[1 : len(pubKeyHash)-addressCheckSumLen]
 	targetCheckSum := checkSum(append([]byte{version}, pubKeyHash...))
 
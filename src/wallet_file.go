@@ -0,0 +1,163 @@
+// @Title 钱包文件加密
+// @Description 钱包文件用口令加密保存：scrypt 从口令派生密钥，AES-256-GCM 加密并校验，文件泄露也拿不到私钥
+package src
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"golang.org/x/crypto/scrypt"
+)
+
+const (
+	walletFileMagic   = "BTCGOWALLET" // 加密钱包文件的开头，没有它的是旧的明文文件
+	walletFileVersion = 1
+	walletKeyLen      = 32 // AES-256
+	walletSaltLen     = 16
+	walletKeyVersion  = 1 // 密钥改用 secp256k1 之后的版本
+)
+
+// scrypt 参数，保存在文件里，以后调整也能解开旧文件
+var walletScryptN, walletScryptR, walletScryptP = 1 << 15, 8, 1
+
+// ErrWrongPassphrase is returned when the wallet file cannot be decrypted with the passphrase
+var ErrWrongPassphrase = errors.New("wrong wallet passphrase")
+
+// 文件中保存的内容，除了 KDF 参数外都是密文
+type encryptedWallet struct {
+	Version    int
+	Salt       []byte
+	N, R, P    int
+	Nonce      []byte
+	Ciphertext []byte
+}
+
+// 加密前的钱包内容。派生的地址只保存种子和个数，其他私钥只保存 D，公钥由它算出来
+type walletData struct {
+	KeyVersion int // 0 是只有 P-256 密钥的旧版本，见 walletKeyVersion
+	Seed       []byte
+	NextIndex  uint32
+	Keys       map[string][]byte // 不是由种子派生的地址 -> secp256k1 私钥
+	LegacyKeys map[string][]byte // 旧版本的地址 -> P-256 私钥
+	MultiSigs  map[string]Script
+}
+
+func (this *encryptedWallet) aead(passphrase []byte) (cipher.AEAD, error) {
+	key, err := scrypt.Key(passphrase, this.Salt, this.N, this.R, this.P, walletKeyLen)
+	if nil != err {
+		return nil, err
+	}
+	block, err := aes.NewCipher(key)
+	if nil != err {
+		return nil, err
+	}
+
+	return cipher.NewGCM(block)
+}
+
+// 头部参与认证，篡改 KDF 参数也会被发现
+func (this *encryptedWallet) additionalData() []byte {
+	return []byte(fmt.Sprintf("%s %d %x %d %d %d", walletFileMagic, this.Version, this.Salt, this.N, this.R, this.P))
+}
+
+func encryptWallet(data walletData, passphrase []byte) ([]byte, error) {
+	var plaintext bytes.Buffer
+	if err := gob.NewEncoder(&plaintext).Encode(data); nil != err {
+		return nil, err
+	}
+
+	file := encryptedWallet{Version: walletFileVersion, Salt: make([]byte, walletSaltLen),
+		N: walletScryptN, R: walletScryptR, P: walletScryptP}
+	if _, err := rand.Read(file.Salt); nil != err {
+		return nil, err
+	}
+	aead, err := file.aead(passphrase)
+	if nil != err {
+		return nil, err
+	}
+	file.Nonce = make([]byte, aead.NonceSize())
+	if _, err := rand.Read(file.Nonce); nil != err {
+		return nil, err
+	}
+	file.Ciphertext = aead.Seal(nil, file.Nonce, plaintext.Bytes(), file.additionalData())
+
+	content := bytes.NewBufferString(walletFileMagic)
+	if err := gob.NewEncoder(content).Encode(file); nil != err {
+		return nil, err
+	}
+
+	return content.Bytes(), nil
+}
+
+func decryptWallet(content, passphrase []byte) (walletData, error) {
+	var (
+		file encryptedWallet
+		data walletData
+	)
+
+	if err := gob.NewDecoder(bytes.NewReader(content[len(walletFileMagic):])).Decode(&file); nil != err {
+		return data, err
+	}
+	if file.Version != walletFileVersion {
+		return data, fmt.Errorf("unsupported wallet file version %d", file.Version)
+	}
+	// 参数在认证之前就要用来派生密钥，超过写文件时用的值就拒绝，免得篡改过的文件耗尽内存
+	if file.N < 2 || file.N > walletScryptN || file.R < 1 || file.R > walletScryptR || file.P < 1 || file.P > walletScryptP {
+		return data, fmt.Errorf("wallet file has bad scrypt parameters N=%d r=%d p=%d", file.N, file.R, file.P)
+	}
+	aead, err := file.aead(passphrase)
+	if nil != err {
+		return data, err
+	}
+	if len(file.Nonce) != aead.NonceSize() {
+		return data, fmt.Errorf("wallet file nonce has %d bytes", len(file.Nonce))
+	}
+	plaintext, err := aead.Open(nil, file.Nonce, file.Ciphertext, file.additionalData())
+	if nil != err {
+		return data, ErrWrongPassphrase
+	}
+
+	err = gob.NewDecoder(bytes.NewReader(plaintext)).Decode(&data)
+
+	return data, err
+}
+
+// IsEncryptedWalletFile reports whether content was written by an encrypting Wallets.SaveToFile
+func IsEncryptedWalletFile(content []byte) bool {
+	return bytes.HasPrefix(content, []byte(walletFileMagic))
+}
+
+// 先写临时文件再改名，写到一半失败也不会损坏原来的钱包；权限只允许本人读写
+func writeWalletFile(walletFile string, content []byte) error {
+	tmp, err := ioutil.TempFile(filepath.Dir(walletFile), filepath.Base(walletFile)+".tmp")
+	if nil != err {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if err := tmp.Chmod(0600); nil != err {
+		tmp.Close()
+		return err
+	}
+	if _, err := tmp.Write(content); nil != err {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); nil != err {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); nil != err {
+		return err
+	}
+
+	return os.Rename(tmp.Name(), walletFile)
+}
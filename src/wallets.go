@@ -4,40 +4,138 @@ import (
     "bytes"
     "crypto/elliptic"
     "encoding/gob"
+    "errors"
     "fmt"
     "io/ioutil"
     "log"
+    "math/big"
     "os"
 )
 
-const walletFile = "wallet_%s.dat"
+const hdGapLimit = 20 // 恢复钱包时，连续这么多个地址都没用过就不再往后找
 
+// 钱包中的地址都由一个种子派生，文件里只保存种子和派生到了第几个；
+// 旧版本随机生成的密钥没有种子，仍然逐个保存
 type Wallets struct {
-    Wallets map[string]*Wallet
+    Wallets    map[string]*Wallet
+    MultiSigs  map[string]Script // 多重签名地址 -> 赎回脚本
+    passphrase []byte            // 加密钱包文件的口令，不保存
+    seed       []byte            // HD 种子，由助记词生成
+    nextIndex  uint32            // 下一个收款地址的序号
+    derived    map[string]bool   // 由种子派生的地址，保存时不必保存私钥
 }
 
-func NewWallets(nodeID string) (*Wallets, error) {
+// NewWallets loads the wallet file of the node, decrypting it with passphrase.
+// 文件不存在时返回空钱包和 os.IsNotExist 的错误，口令错误时返回 ErrWrongPassphrase
+func NewWallets(nodeID string, passphrase []byte) (*Wallets, error) {
     wallets := Wallets{}
     wallets.Wallets = make(map[string]*Wallet)
+    wallets.MultiSigs = make(map[string]Script)
+    wallets.passphrase = passphrase
+    wallets.derived = make(map[string]bool)
 
     err := wallets.LoadFromFile(nodeID)
 
     return &wallets, err
 }
 
-// CreateWallet adds a Wallet to Wallets
+// CreateWallet derives the next receive address from the seed and adds its Wallet to Wallets
 func (this *Wallets) CreateWallet() string {
-    wallet := NewWallet()
-    address := fmt.Sprintf("%s", wallet.GetAddress())
+    if !this.HasSeed() {
+        panic("ERROR: Wallet has no seed, set a mnemonic first")
+    }
 
-    this.Wallets[address] = wallet
+    wallet := this.deriveNext()
+    this.nextIndex++
 
-    return address
+    return fmt.Sprintf("%s", wallet.GetAddress())
+}
+
+// HasSeed reports whether addresses can be derived, i.e. a mnemonic was set or loaded
+func (this Wallets) HasSeed() bool {
+    return len(this.seed) > 0
+}
+
+// SetMnemonic makes the wallet derive its addresses from the mnemonic, starting from the first address
+func (this *Wallets) SetMnemonic(mnemonic string) error {
+    if this.HasSeed() {
+        return errors.New("wallet already has a seed")
+    }
+    seed, err := MnemonicToSeed(mnemonic, "")
+    if nil != err {
+        return err
+    }
+    if _, err := newMasterKey(seed, keyCurve()); nil != err {
+        return err
+    }
+
+    this.seed, this.nextIndex = seed, 0
+
+    return nil
+}
+
+// Restore derives addresses until hdGapLimit addresses in a row are unused, keeping the ones up to the last used.
+// used 判断公钥哈希在链上是否出现过。返回恢复了多少个地址
+func (this *Wallets) Restore(used func(pubKeyHash []byte) bool) int {
+    lastUsed := -1
+    for i, gap := this.nextIndex, 0; gap < hdGapLimit; i++ {
+        wallet, err := this.derive(keyCurve(), i)
+        if nil != err {
+            continue
+        }
+        if used(HashPubKey(wallet.PublicKey)) {
+            lastUsed, gap = int(i), 0
+        } else {
+            gap++
+        }
+    }
+
+    restored := 0
+    for int(this.nextIndex) <= lastUsed {
+        this.deriveNext()
+        this.nextIndex++
+        restored++
+    }
+
+    return restored
+}
+
+// 派生 nextIndex 处的地址加入钱包。极少数序号派生不出合法的密钥，跳过它们
+func (this *Wallets) deriveNext() *Wallet {
+    for {
+        wallet, err := this.derive(keyCurve(), this.nextIndex)
+        if nil == err {
+            address := fmt.Sprintf("%s", wallet.GetAddress())
+            this.Wallets[address] = wallet
+            if this.derived == nil {
+                this.derived = make(map[string]bool)
+            }
+            this.derived[address] = true
+
+            return wallet
+        }
+        this.nextIndex++
+    }
+}
+
+// 在 curve 上派生第 index 个收款地址的密钥
+func (this Wallets) derive(curve elliptic.Curve, index uint32) (*Wallet, error) {
+    master, err := newMasterKey(this.seed, curve)
+    if nil != err {
+        return nil, err
+    }
+    key, err := master.derive(receivePath(index))
+    if nil != err {
+        return nil, err
+    }
+
+    return walletFromKey(curve, key.key), nil
 }
 
-// LoadFromFile loads wallets from the file
+// LoadFromFile loads wallets from the file.
+// 旧版本写的明文文件也能读，下次保存时加密
 func (this *Wallets) LoadFromFile(nodeID string) error {
-    walletFile := fmt.Sprintf(walletFile, nodeID)
+    walletFile := fmt.Sprintf(ActiveChainParams().WalletFile, nodeID)
     if _, err := os.Stat(walletFile); os.IsNotExist(err) {
         return err
     }
@@ -47,38 +145,172 @@ func (this *Wallets) LoadFromFile(nodeID string) error {
         log.Panic(err)
     }
 
-    var wallets Wallets
-    gob.Register(elliptic.P256())
+    if !IsEncryptedWalletFile(fileContent) {
+        return this.loadPlaintext(fileContent)
+    }
+
+    data, err := decryptWallet(fileContent, this.passphrase)
+    if nil != err {
+        return err
+    }
+    this.seed = data.Seed
+    if data.KeyVersion < walletKeyVersion {
+        this.migrateLegacyKeys(data)
+    } else {
+        for address, key := range data.Keys {
+            this.Wallets[address] = NewWalletFromKey(key)
+        }
+        for address, key := range data.LegacyKeys {
+            this.Wallets[address] = newLegacyWalletFromKey(key)
+        }
+        for this.nextIndex = 0; this.nextIndex < data.NextIndex; this.nextIndex++ {
+            this.deriveNext()
+        }
+    }
+    if data.MultiSigs != nil {
+        this.MultiSigs = data.MultiSigs
+    }
+
+    return nil
+}
+
+// 旧版本的钱包全是 P-256 密钥，包括由种子派生的。它们原样保留为单独的密钥，地址和余额都不变；
+// 种子从第一个地址开始重新派生 secp256k1 密钥
+func (this *Wallets) migrateLegacyKeys(data walletData) {
+    for address, key := range data.Keys {
+        this.Wallets[address] = newLegacyWalletFromKey(key)
+    }
+    for index := uint32(0); index < data.NextIndex; index++ {
+        if wallet, err := this.derive(elliptic.P256(), index); nil == err {
+            this.Wallets[fmt.Sprintf("%s", wallet.GetAddress())] = wallet
+        }
+    }
+    this.nextIndex = 0
+}
+
+// 旧格式的明文文件：整个 Wallets 直接 gob 编码，私钥是带着 Curve 接口的 ecdsa.PrivateKey。
+// 接口里存的是当时标准库 P-256 的具体类型，现在已经没有这个类型，解不出来，所以只读私钥 D，gob 会跳过其余字段
+type plaintextWallets struct {
+    Wallets map[string]*struct {
+        PrivateKey struct {
+            D *big.Int
+        }
+    }
+    MultiSigs map[string]Script
+}
+
+// 旧格式的密钥都是 P-256 的，公钥由 D 重新算出来
+func (this *Wallets) loadPlaintext(fileContent []byte) error {
+    var wallets plaintextWallets
     decoder := gob.NewDecoder(bytes.NewReader(fileContent))
-    err = decoder.Decode(&wallets)
-    if err != nil {
-        log.Panic(err)
+    if err := decoder.Decode(&wallets); nil != err {
+        return err
     }
 
-    this.Wallets = wallets.Wallets
+    for address, wallet := range wallets.Wallets {
+        if wallet == nil || wallet.PrivateKey.D == nil || wallet.PrivateKey.D.Sign() <= 0 {
+            return fmt.Errorf("wallet file has no private key for %s", address)
+        }
+        this.Wallets[address] = newLegacyWalletFromKey(wallet.PrivateKey.D.Bytes())
+    }
+    if wallets.MultiSigs != nil {
+        this.MultiSigs = wallets.MultiSigs
+    }
+    this.passphrase = nil // 明文文件没有口令，保存之前要先设置
 
     return nil
 }
 
-// SaveToFile saves wallets to a file
+// SaveToFile encrypts the wallets with the passphrase and writes them to the file, readable only by the owner
 func (this Wallets) SaveToFile(nodeID string) {
-    var content bytes.Buffer
-    walletFile := fmt.Sprintf(walletFile, nodeID)
-
-    gob.Register(elliptic.P256())
+    walletFile := fmt.Sprintf(ActiveChainParams().WalletFile, nodeID)
+    if !this.HasPassphrase() {
+        panic("ERROR: Wallet passphrase is not set")
+    }
 
-    encoder := gob.NewEncoder(&content)
-    err := encoder.Encode(this)
+    data := walletData{walletKeyVersion, this.seed, this.nextIndex, make(map[string][]byte), make(map[string][]byte),
+        this.MultiSigs}
+    for address, wallet := range this.Wallets {
+        if this.derived[address] {
+            continue
+        }
+        if isLegacyKey(wallet.PrivateKey.PublicKey) {
+            data.LegacyKeys[address] = wallet.PrivateKey.D.Bytes()
+        } else {
+            data.Keys[address] = wallet.PrivateKey.D.Bytes()
+        }
+    }
+    content, err := encryptWallet(data, this.passphrase)
     if err != nil {
         panic(err)
     }
 
-    err = ioutil.WriteFile(walletFile, content.Bytes(), 0644)
+    err = writeWalletFile(walletFile, content)
     if err != nil {
         panic(err)
     }
 }
 
+// HasPassphrase reports whether the wallets can be saved: they were decrypted or a passphrase was set
+func (this Wallets) HasPassphrase() bool {
+    return len(this.passphrase) > 0
+}
+
+// ChangePassphrase sets the passphrase used by the next SaveToFile
+func (this *Wallets) ChangePassphrase(passphrase []byte) {
+    this.passphrase = passphrase
+}
+
+// AddMultiSig remembers an M-of-N multisig address and returns it
+func (this *Wallets) AddMultiSig(m int, pubKeys [][]byte) string {
+    redeemScript := MultiSigScript(m, pubKeys)
+    if _, _, err := ParseMultiSigScript(redeemScript); nil != err {
+        panic(err)
+    }
+    address := string(ScriptHashAddress(redeemScript))
+
+    this.MultiSigs[address] = redeemScript
+
+    return address
+}
+
+// GetMultiSig returns the redeem script of a multisig address
+func (this Wallets) GetMultiSig(address string) (Script, bool) {
+    redeemScript, ok := this.MultiSigs[address]
+
+    return redeemScript, ok
+}
+
+// ExportKey returns the private key of address in WIF.
+// 旧版本的 P-256 密钥没有 WIF 格式，只能把币转到新地址
+func (this Wallets) ExportKey(address string) (string, error) {
+    wallet, ok := this.Wallets[address]
+    if !ok {
+        return "", fmt.Errorf("address %s is not in the wallet", address)
+    }
+    if isLegacyKey(wallet.PrivateKey.PublicKey) {
+        return "", fmt.Errorf("address %s has a legacy P-256 key, send its coins to a new address", address)
+    }
+
+    return EncodeWIF(wallet.PrivateKey.D.FillBytes(make([]byte, 32))), nil
+}
+
+// ImportKey adds the private key in WIF to the wallet and returns its address.
+// 导入的密钥不是由种子派生的，助记词备份不了它，保存时单独保存私钥
+func (this *Wallets) ImportKey(wif string) (string, error) {
+    key, err := DecodeWIF(wif)
+    if nil != err {
+        return "", err
+    }
+    wallet := NewWalletFromKey(key)
+    address := fmt.Sprintf("%s", wallet.GetAddress())
+    if _, ok := this.Wallets[address]; !ok {
+        this.Wallets[address] = wallet
+    }
+
+    return address, nil
+}
+
 // return a Wallet by its address
 func (this Wallets) GetWallet(address string) Wallet {
     return *this.Wallets[address]
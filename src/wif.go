@@ -0,0 +1,59 @@
+// @Title WIF 私钥
+// @Description Wallet Import Format：私钥的 Base58Check 编码，用来在节点、钱包之间导出导入单个密钥
+package src
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"math/big"
+)
+
+const wifCompressed = 0x01 // 私钥后面的这个字节表示对应的公钥是压缩公钥
+
+// ErrBadWIF is returned for a string that is not a WIF private key of the active network
+var ErrBadWIF = errors.New("invalid WIF private key")
+
+// EncodeWIF encodes a 32 byte secp256k1 private key: version + key + 0x01 + checksum, in Base58.
+// 钱包的公钥都是压缩的，所以总是带上压缩标志
+func EncodeWIF(key []byte) string {
+	payload := append([]byte{ActiveChainParams().PrivateKeyVersion}, key...)
+	payload = append(payload, wifCompressed)
+	payload = append(payload, checkSum(payload)...)
+
+	return string(Base58Encode(payload))
+}
+
+// DecodeWIF checks the checksum, the version byte and the range of the key and returns the 32 byte private key
+func DecodeWIF(wif string) ([]byte, error) {
+	if len(wif) == 0 || len(wif) > 64 {
+		return nil, ErrBadWIF
+	}
+	for i := 0; i < len(wif); i++ {
+		if bytes.IndexByte(b58Alphabet, wif[i]) < 0 {
+			return nil, fmt.Errorf("%w: bad character %q", ErrBadWIF, wif[i])
+		}
+	}
+
+	payload := Base58Decode([]byte(wif))
+	if len(payload) <= addressCheckSumLen {
+		return nil, ErrBadWIF
+	}
+	payload, checksum := payload[:len(payload)-addressCheckSumLen], payload[len(payload)-addressCheckSumLen:]
+	if !bytes.Equal(checksum, checkSum(payload)) {
+		return nil, fmt.Errorf("%w: wrong checksum", ErrBadWIF)
+	}
+	if payload[0] != ActiveChainParams().PrivateKeyVersion {
+		return nil, fmt.Errorf("%w: key of another network", ErrBadWIF)
+	}
+	// 没有压缩标志的私钥对应未压缩公钥的地址，这个钱包生成不了那种地址
+	if len(payload) != 1+32+1 || payload[33] != wifCompressed {
+		return nil, fmt.Errorf("%w: only keys of compressed public keys are supported", ErrBadWIF)
+	}
+	key := payload[1:33]
+	if d := new(big.Int).SetBytes(key); d.Sign() == 0 || d.Cmp(keyCurve().Params().N) >= 0 {
+		return nil, fmt.Errorf("%w: key out of range", ErrBadWIF)
+	}
+
+	return key, nil
+}
@@ -1,6 +1,12 @@
 package test
 
-import "testing"
+import (
+	. "bitcoin_go/src"
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
 
 var address = "18vhdHeZ2XJLSSd861p4XxFVYwaLeNcGP2" // 通过 ListAddress() 查出来地址列表，赋值到这里。
 
@@ -12,3 +18,102 @@ func TestPrintChain(t *testing.T) {
 	cli.PrintChain(nodeID)
 }
 
+
+func TestGetBlockByHeight(t *testing.T) {
+	wallet, blockChain, _ := newTestSet(t)
+	genesis, err := blockChain.GetBlockByHeight(0)
+	assert.NoError(t, err)
+	assert.Equal(t, 0, genesis.Height)
+
+	block := blockChain.MineBlock([]*Transaction{CreateCoinBaseTX(string(wallet.GetAddress()), "", 1)})
+	assert.Equal(t, 1, block.Height)
+	assert.Equal(t, 1, blockChain.GetBestHeight())
+
+	found, err := blockChain.GetBlockByHeight(1)
+	assert.NoError(t, err)
+	assert.Equal(t, block.Hash, found.Hash)
+
+	_, err = blockChain.GetBlockByHeight(2)
+	assert.Error(t, err)
+
+	assert.Equal(t, [][]byte{genesis.Hash, block.Hash}, blockChain.GetBlockHashes(0, 5))
+	assert.Equal(t, [][]byte{block.Hash}, blockChain.GetBlockHashes(1, 1))
+}
+
+func TestReorganize(t *testing.T) {
+	alice, blockChain, set := newTestSet(t)
+	bob := NewWallet()
+	genesis, _ := blockChain.GetBlockByHeight(0)
+
+	mainBlock := blockChain.MineBlock([]*Transaction{CreateCoinBaseTX(string(alice.GetAddress()), "", 1)})
+	assert.Equal(t, 20, balanceOf(set, alice))
+
+	// 同样长度的分支只保存，不切换
+	fork1 := NewBlock([]*Transaction{CreateCoinBaseTX(string(bob.GetAddress()), "", 1)}, genesis.Hash, 1, genesis.Bits)
+	assert.NoError(t, blockChain.AddBlock(fork1))
+	tip, _ := blockChain.GetBlockByHeight(1)
+	assert.Equal(t, mainBlock.Hash, tip.Hash)
+	assert.Equal(t, 0, balanceOf(set, bob))
+
+	// 分支更重了，重组过去
+	fork2 := NewBlock([]*Transaction{CreateCoinBaseTX(string(bob.GetAddress()), "", 2)}, fork1.Hash, 2, fork1.Bits)
+	assert.NoError(t, blockChain.AddBlock(fork2))
+	assert.Equal(t, 2, blockChain.GetBestHeight())
+	assert.Equal(t, [][]byte{genesis.Hash, fork1.Hash, fork2.Hash}, blockChain.GetBlockHashes(0, 2))
+	assert.Equal(t, 10, balanceOf(set, alice))
+	assert.Equal(t, 20, balanceOf(set, bob))
+
+	assert.Error(t, blockChain.AddBlock(NewBlock([]*Transaction{}, []byte("unknown"), 1, genesis.Bits)))
+}
+
+func TestReorganizeMempool(t *testing.T) {
+	alice, blockChain, set := newTestSet(t)
+	bob := NewWallet()
+	pool := NewMempool()
+	blockChain.SetMempool(pool)
+	genesis, _ := blockChain.GetBlockByHeight(0)
+
+	tx := NewUnsignedTransaction(string(alice.GetAddress()), string(bob.GetAddress()), 3, 0, &set)
+	blockChain.SignTransaction(tx, alice.PrivateKey)
+	blockChain.MineBlock([]*Transaction{CreateCoinBaseTX(string(alice.GetAddress()), "", 1), tx})
+	assert.Equal(t, 3, balanceOf(set, bob))
+
+	// 更重的分支上没有这笔交易，重组后它回到内存池，等着重新打包
+	fork1 := NewBlock([]*Transaction{CreateCoinBaseTX(string(bob.GetAddress()), "", 1)}, genesis.Hash, 1, genesis.Bits)
+	assert.NoError(t, blockChain.AddBlock(fork1))
+	fork2 := NewBlock([]*Transaction{CreateCoinBaseTX(string(bob.GetAddress()), "", 2)}, fork1.Hash, 2, fork1.Bits)
+	assert.NoError(t, blockChain.AddBlock(fork2))
+	assert.Equal(t, 20, balanceOf(set, bob), "only the rewards of the new branch")
+	assert.True(t, pool.Has(tx.ID))
+	assert.Equal(t, 1, pool.Count())
+}
+
+func TestGetTxProof(t *testing.T) {
+	_, blockChain, _ := newTestSet(t)
+	genesis, _ := blockChain.GetBlockByHeight(0)
+	coinBase := genesis.Transcations[0]
+
+	proof, err := blockChain.GetTxProof(coinBase.ID)
+	assert.NoError(t, err)
+	assert.Equal(t, genesis.Hash, proof.BlockHash)
+	assert.Equal(t, genesis.MerkleRoot, proof.MerkleRoot)
+	assert.True(t, VerifyMerkleProof(coinBase.ID, proof.Path, proof.MerkleRoot))
+
+	_, err = blockChain.GetTxProof([]byte("unknown"))
+	assert.Error(t, err)
+}
+
+func TestMineBlockContext(t *testing.T) {
+	alice, blockChain, set := newTestSet(t)
+	bob := NewWallet()
+	tx := NewUTXOTransaction(alice, string(bob.GetAddress()), 3, 1, &set)
+	blockChain.MineBlock([]*Transaction{CreateCoinBaseTX(string(bob.GetAddress()), "", 1)})
+
+	// coinbase 按挖矿时读到的 tip 算高度和奖励
+	block, err := blockChain.MineBlockContext(context.Background(), string(bob.GetAddress()), 1, []*Transaction{tx})
+	assert.NoError(t, err)
+	assert.Equal(t, 2, block.Height)
+	assert.Equal(t, 2, blockChain.GetBestHeight())
+	assert.True(t, block.Transcations[0].IsCoinBase())
+	assert.Equal(t, ActiveChainParams().BlockSubsidy(2)+1, block.Transcations[0].Vout[0].Value)
+}
@@ -0,0 +1,57 @@
+package test
+
+import (
+	. "bitcoin_go/src"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBlockSubsidy(t *testing.T) {
+	params := RegTestParams
+	params.HalvingInterval = 2
+	params.MaxSupply = 35
+
+	// 10 10 5 5 2 2 1 0：到第 6 个块已经发行了 34，第 7 个块只剩 1
+	assert.Equal(t, []int{10, 10, 5, 5, 2, 2, 1, 0}, []int{params.BlockSubsidy(0), params.BlockSubsidy(1),
+		params.BlockSubsidy(2), params.BlockSubsidy(3), params.BlockSubsidy(4), params.BlockSubsidy(5),
+		params.BlockSubsidy(6), params.BlockSubsidy(7)})
+	assert.Equal(t, 34, params.Supply(5))
+	assert.Equal(t, 35, params.Supply(100))
+	assert.Equal(t, 0, params.Supply(-1))
+
+	assert.Equal(t, 210000*10+210000*5+210000*2+210000, MainNetParams.Supply(10000000))
+}
+
+func TestHalvingEnforced(t *testing.T) {
+	miner, blockChain, _ := newTestSet(t)
+	minerAddress := string(miner.GetAddress())
+	params := *ActiveChainParams()
+	params.HalvingInterval = 2
+	SetChainParams(&params)
+
+	blockChain.MineBlock([]*Transaction{CreateCoinBaseTX(minerAddress, "", 1)})
+	tip, _ := blockChain.GetBlockByHeight(1)
+
+	greedy := CreateCoinBaseTX(minerAddress, "", 1)
+	assert.ErrorIs(t, blockChain.AddBlock(NewBlock([]*Transaction{greedy}, tip.Hash, 2, tip.Bits)), ErrBadCoinBaseVal)
+
+	block := blockChain.MineBlock([]*Transaction{CreateCoinBaseTX(minerAddress, "", 2)})
+	assert.Equal(t, 5, block.Transcations[0].Vout[0].Value)
+}
+
+func TestOverride(t *testing.T) {
+	params := MainNetParams
+	assert.NoError(t, params.Override("maturity", 0))
+	assert.Equal(t, 0, params.CoinbaseMaturity)
+	assert.Equal(t, 100, MainNetParams.CoinbaseMaturity, "presets are not changed")
+	assert.Error(t, params.Override("maturity", -1))
+	assert.Error(t, params.Override("unknown", 1))
+
+	assert.NoError(t, params.Override("halving", 2))
+	assert.NoError(t, params.Override("max_supply", 35))
+	assert.Equal(t, 35, params.Supply(100))
+	assert.Equal(t, 5, params.BlockSubsidy(2))
+	assert.Error(t, params.Override("halving", 0), "the subsidy is constant within an interval")
+	assert.Error(t, params.Override("max_supply", 0))
+}
@@ -2,9 +2,72 @@ package test
 
 import (
 	. "bitcoin_go/src"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
 )
 
 var (
 	nodeID = "1234"
 	cli CLI
-)
\ No newline at end of file
+	testData string // testdata 目录的绝对路径，TestMain 切换工作目录之前记下来
+)
+
+// CLI 的钱包口令从环境变量读取，测试时不在终端提示输入
+func init() {
+	os.Setenv("WALLET_PASSPHRASE", "test")
+}
+
+// 在临时目录里运行测试，上次运行留下的链和钱包文件不会影响这次
+func TestMain(m *testing.M) {
+	wd, err := os.Getwd()
+	if nil != err {
+		panic(err)
+	}
+	testData = filepath.Join(wd, "testdata")
+
+	dir, err := ioutil.TempDir("", "bitcoin_go")
+	if nil != err {
+		panic(err)
+	}
+	if err := os.Chdir(dir); nil != err {
+		panic(err)
+	}
+
+	code := m.Run()
+	os.RemoveAll(dir)
+	os.Exit(code)
+}
+
+// 切换到回归测试网，挖矿几乎不花时间。链和钱包文件都放在这个测试的临时目录里，测试结束后切回原来的网络
+func useRegTest(t *testing.T) {
+	previous := ActiveChainParams()
+	params := RegTestParams
+	dir := t.TempDir()
+	params.DBFile = filepath.Join(dir, params.DBFile)
+	params.WalletFile = filepath.Join(dir, params.WalletFile)
+	SetChainParams(&params)
+
+	t.Cleanup(func() { SetChainParams(previous) })
+}
+
+// 在当前网络上新建一条链，创世块的奖励给 address。测试结束时关闭数据库
+func newTestChain(t *testing.T, address string) *BlockChain {
+	blockChain := CreateBlockChain(address, nodeID)
+	t.Cleanup(func() { blockChain.Close() })
+
+	return blockChain
+}
+
+// 大多数测试的准备工作：切换到回归测试网，新建一条链，创世块的奖励给返回的钱包，UTXO 集已经建好
+func newTestSet(t *testing.T) (*Wallet, *BlockChain, UTXOSet) {
+	useRegTest(t)
+
+	wallet := NewWallet()
+	blockChain := newTestChain(t, string(wallet.GetAddress()))
+	set := UTXOSet{BlockChain: blockChain}
+	set.ReIndex()
+
+	return wallet, blockChain, set
+}
@@ -0,0 +1,99 @@
+package test
+
+import (
+	. "bitcoin_go/src"
+	"bytes"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMempool(t *testing.T) {
+	sender, _, set := newTestSet(t)
+	receiver := NewWallet()
+
+	pool := NewMempool()
+	tx := NewUTXOTransaction(sender, string(receiver.GetAddress()), 3, 0, &set)
+	assert.NoError(t, pool.Add(tx, &set))
+	assert.Error(t, pool.Add(tx, &set), "duplicate transaction is rejected")
+
+	doubleSpend := NewUTXOTransaction(sender, string(receiver.GetAddress()), 4, 0, &set)
+	assert.Error(t, pool.Add(doubleSpend, &set), "transaction spending the same output is rejected")
+	assert.Equal(t, 1, pool.Count())
+
+	pool.RemoveBlockTransactions(&Block{Transcations: []*Transaction{tx}})
+	assert.Equal(t, 0, pool.Count())
+}
+
+func TestMempoolSelectByFeeRate(t *testing.T) {
+	alice, blockChain, set := newTestSet(t)
+	bob := NewWallet()
+	receiver := NewWallet()
+	blockChain.MineBlock([]*Transaction{CreateCoinBaseTX(string(bob.GetAddress()), "", 1)})
+
+	pool := NewMempool()
+	cheap := NewUTXOTransaction(alice, string(receiver.GetAddress()), 3, 1, &set)
+	generous := NewUTXOTransaction(bob, string(receiver.GetAddress()), 3, 2, &set)
+	assert.NoError(t, pool.Add(cheap, &set))
+	assert.NoError(t, pool.Add(generous, &set))
+	fee, _ := pool.Fee(generous.ID)
+	assert.Equal(t, 2, fee)
+
+	txs, fees := pool.SelectTransactions(1 << 20)
+	assert.Equal(t, [][]byte{generous.ID, cheap.ID}, [][]byte{txs[0].ID, txs[1].ID})
+	assert.Equal(t, 3, fees)
+
+	txs, fees = pool.SelectTransactions(len(generous.Serialize()))
+	assert.Len(t, txs, 1, "only the higher fee rate transaction fits")
+	assert.Equal(t, 2, fees)
+
+	// 矿工收取奖励金加手续费，多收一点都不行
+	txs, fees = pool.SelectTransactions(1 << 20)
+	tip, _ := blockChain.GetBlockByHeight(1)
+	greedy := CreateCoinBaseTXWithFees(string(receiver.GetAddress()), "", 2, fees+1)
+	overpaid := NewBlock(append([]*Transaction{greedy}, txs...), tip.Hash, 2, tip.Bits)
+	assert.ErrorIs(t, blockChain.AddBlock(overpaid), ErrBadCoinBaseVal)
+
+	coinBase := CreateCoinBaseTXWithFees(string(receiver.GetAddress()), "", 2, fees)
+	block := blockChain.MineBlock(append([]*Transaction{coinBase}, txs...))
+	assert.Equal(t, 2, block.Height)
+	assert.Equal(t, 3+3+10+3, balanceOf(set, receiver))
+}
+
+// 接连发出的两笔交易，后一笔不能再花前一笔还在内存池里的输入
+func TestSelectCoinsSkipsPending(t *testing.T) {
+	sender, blockChain, set := newTestSet(t)
+	receiver := NewWallet()
+	blockChain.MineBlock([]*Transaction{CreateCoinBaseTX(string(sender.GetAddress()), "", 1)})
+
+	first := NewUTXOTransaction(sender, string(receiver.GetAddress()), 3, 0, &set)
+	assert.NoError(t, blockChain.AddPending(first))
+	blockChain.LoadPending()
+
+	second := NewUTXOTransaction(sender, string(receiver.GetAddress()), 3, 0, &set)
+	assert.False(t, sharesInput(first, second))
+	pool := NewMempool()
+	assert.NoError(t, pool.Add(first, &set))
+	assert.NoError(t, pool.Add(second, &set))
+
+	// 第一笔打包之后，它的记录被删掉，找零可以花了；第二笔还没打包，它的输入仍然跳过
+	assert.NoError(t, blockChain.AddPending(second))
+	blockChain.MineBlock([]*Transaction{CreateCoinBaseTX(string(receiver.GetAddress()), "", 2), first})
+	blockChain.LoadPending()
+
+	third := NewUTXOTransaction(sender, string(receiver.GetAddress()), 3, 0, &set)
+	assert.False(t, sharesInput(second, third))
+	assert.Equal(t, first.ID, third.Vin[0].Txid, "spends the change of the mined transaction")
+}
+
+func sharesInput(a, b *Transaction) bool {
+	for _, x := range a.Vin {
+		for _, y := range b.Vin {
+			if bytes.Equal(x.Txid, y.Txid) && x.Vout == y.Vout {
+				return true
+			}
+		}
+	}
+
+	return false
+}
@@ -75,3 +75,55 @@ func TestNewMerkleTree(t *testing.T) {
 }
 
 
+func TestNewMerkleTreeOddLevels(t *testing.T) {
+    data := [][]byte{
+        []byte("node1"),
+        []byte("node2"),
+        []byte("node3"),
+        []byte("node4"),
+        []byte("node5"),
+    }
+
+    // Level 1
+    n1 := NewMerkleNode(nil, nil, data[0])
+    n2 := NewMerkleNode(nil, nil, data[1])
+    n3 := NewMerkleNode(nil, nil, data[2])
+    n4 := NewMerkleNode(nil, nil, data[3])
+    n5 := NewMerkleNode(nil, nil, data[4])
+
+    // Level 2, node5 is paired with itself
+    n6 := NewMerkleNode(n1, n2, nil)
+    n7 := NewMerkleNode(n3, n4, nil)
+    n8 := NewMerkleNode(n5, n5, nil)
+
+    // Level 3, n8 is paired with itself
+    n9 := NewMerkleNode(n6, n7, nil)
+    n10 := NewMerkleNode(n8, n8, nil)
+
+    // Level 4
+    root := NewMerkleNode(n9, n10, nil)
+
+    mTree := NewMerkleTree(data)
+    assert.Equal(t, root.Data, mTree.RootNode.Data, "Merkle tree root hash is correct")
+
+    single := NewMerkleTree(data[:1])
+    assert.Equal(t, NewMerkleNode(n1, n1, nil).Data, single.RootNode.Data, "Single leaf is paired with itself")
+}
+
+func TestMerkleProof(t *testing.T) {
+    var data [][]byte
+    for i := 0; i < 7; i++ {
+        data = append(data, []byte(fmt.Sprintf("node%d", i+1)))
+
+        mTree := NewMerkleTree(data)
+        for index, leaf := range data {
+            proof, err := mTree.Proof(index)
+            assert.NoError(t, err)
+            assert.True(t, VerifyMerkleProof(leaf, proof, mTree.RootNode.Data), "leaf %d of %d", index, len(data))
+            assert.False(t, VerifyMerkleProof([]byte("other"), proof, mTree.RootNode.Data))
+        }
+
+        _, err := mTree.Proof(len(data))
+        assert.Error(t, err)
+    }
+}
@@ -0,0 +1,45 @@
+package test
+
+import (
+	. "bitcoin_go/src"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPartialTransaction(t *testing.T) {
+	cold, blockChain, set := newTestSet(t)
+	bob := NewWallet()
+
+	// 联网节点只知道地址
+	tx := NewUnsignedTransaction(string(cold.GetAddress()), string(bob.GetAddress()), 3, 1, &set)
+	partial, err := NewPartialTransaction(tx, &set)
+	assert.NoError(t, err)
+	file := filepath.Join(t.TempDir(), "tx.hex")
+	assert.NoError(t, partial.WriteFile(file))
+
+	// 离线节点只有钱包
+	offline, err := ReadPartialTransaction(file)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, offline.Fee())
+	assert.False(t, offline.IsComplete())
+	signed, err := offline.Sign(bob.PrivateKey)
+	assert.NoError(t, err)
+	assert.Equal(t, 0, signed, "bob owns none of the inputs")
+	signed, err = offline.Sign(cold.PrivateKey)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, signed)
+	assert.True(t, offline.IsComplete())
+	assert.NoError(t, offline.WriteFile(file))
+
+	signedTx, err := ReadPartialTransaction(file)
+	assert.NoError(t, err)
+	assert.True(t, blockChain.VerifyTransaction(&signedTx.Tx))
+	assert.NoError(t, NewMempool().Add(&signedTx.Tx, &set))
+
+	forged := *partial
+	forged.PrevOutputs = nil
+	_, err = forged.Sign(cold.PrivateKey)
+	assert.Error(t, err, "previous outputs must match the inputs")
+}
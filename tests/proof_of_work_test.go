@@ -2,16 +2,20 @@ package test
 
 import (
     // system package
+    "context"
     "crypto/sha256"
     "encoding/hex"
     "fmt"
     "math/big"
+    "runtime"
     "testing"
+    "time"
 
     // third package
     "github.com/stretchr/testify/assert"
 
     // item package
+    . "bitcoin_go/src"
 )
 
 func TestPow(t *testing.T) {
@@ -36,3 +40,55 @@ func TestPow(t *testing.T) {
     fmt.Printf("%x\n", data2Hash)
 }
 
+func TestCompactBits(t *testing.T) {
+    // 比特币创世块的难度
+    target := CompactToBig(0x1d00ffff)
+    assert.Equal(t, "ffff0000000000000000000000000000000000000000000000000000",
+        hex.EncodeToString(target.Bytes()))
+    assert.Equal(t, uint32(0x1d00ffff), BigToCompact(target))
+
+    target = new(big.Int).Lsh(big.NewInt(1), 256-24)
+    assert.Equal(t, uint32(0x1e010000), BigToCompact(target))
+    assert.Equal(t, target, CompactToBig(0x1e010000))
+
+    // 最高位是符号位，0x80 开头的有效数字要多占一个字节
+    assert.Equal(t, uint32(0x02008000), BigToCompact(big.NewInt(0x80)))
+    assert.Equal(t, big.NewInt(0x80), CompactToBig(0x02008000))
+}
+
+func TestCalculateNextBits(t *testing.T) {
+    bits := uint32(0x1e010000)
+    target := CompactToBig(bits)
+    expectedTimespan := int64(90) // 10 个块，9 个间隔，每个 10 秒
+
+    assert.Equal(t, bits, CalculateNextBits(bits, expectedTimespan), "on schedule")
+    assert.Equal(t, new(big.Int).Div(target, big.NewInt(2)), CompactToBig(CalculateNextBits(bits, expectedTimespan/2)),
+        "blocks came twice as fast, target is halved")
+    assert.Equal(t, new(big.Int).Div(target, big.NewInt(4)), CompactToBig(CalculateNextBits(bits, 1)),
+        "adjustment is clamped to 4 times")
+    assert.Equal(t, new(big.Int).Mul(target, big.NewInt(4)), CompactToBig(CalculateNextBits(bits, 100000)),
+        "adjustment is clamped to 4 times")
+
+    easiest := BigToCompact(new(big.Int).Lsh(big.NewInt(1), 256-8))
+    assert.Equal(t, easiest, CalculateNextBits(easiest, 100000), "target never exceeds the limit")
+}
+
+func TestParallelRun(t *testing.T) {
+    SetMiningWorkers(4)
+    defer SetMiningWorkers(runtime.NumCPU())
+
+    bits := BigToCompact(new(big.Int).Lsh(big.NewInt(1), 256-12))
+    block := NewBlock([]*Transaction{}, []byte{}, 0, bits)
+    pow := NewProofOfWork(block)
+    assert.True(t, pow.Validate())
+
+    // 目标值是 1，不可能挖到，只能等被取消
+    impossible := &Block{Timestamp: time.Now().Unix(), Bits: 0x01010000}
+    ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+    defer cancel()
+    pow = NewProofOfWork(impossible)
+    _, hash, err := pow.Run(ctx)
+    assert.Nil(t, hash)
+    assert.ErrorIs(t, err, context.DeadlineExceeded)
+    assert.Greater(t, pow.HashRate(), float64(0))
+}
@@ -0,0 +1,119 @@
+package test
+
+import (
+	. "bitcoin_go/src"
+	"bytes"
+	"encoding/hex"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// 签名就是 "sig:" 加公钥，锁定时间固定为 100
+type fakeChecker struct{}
+
+func (fakeChecker) CheckSig(signature, pubKey []byte) bool {
+	return bytes.Equal(signature, append([]byte("sig:"), pubKey...))
+}
+
+func (fakeChecker) CheckLockTime(lockTime int64) bool {
+	return lockTime <= 100
+}
+
+func TestScriptPayToPubKeyHash(t *testing.T) {
+	alice := NewWallet()
+	bob := NewWallet()
+
+	prevTx := CreateCoinBaseTX(string(alice.GetAddress()), "", 0)
+	assert.Equal(t, HashPubKey(alice.PublicKey), prevTx.Vout[0].ScriptPubKey.PubKeyHash())
+	assert.Equal(t, "OP_DUP OP_HASH160 "+hex.EncodeToString(HashPubKey(alice.PublicKey))+" OP_EQUALVERIFY OP_CHECKSIG",
+		prevTx.Vout[0].ScriptPubKey.String())
+
+	tx := Transaction{Vin: []TXInput{{Txid: prevTx.ID, Vout: 0}},
+		Vout: []TXOutput{*NewTXOutput(10, string(bob.GetAddress()))}}
+	tx.SetID()
+	prevTXs := map[string]Transaction{hex.EncodeToString(prevTx.ID): *prevTx}
+
+	tx.Sign(alice.PrivateKey, prevTXs)
+	assert.True(t, tx.Verify(prevTXs))
+
+	tampered := tx
+	tampered.Vout = []TXOutput{*NewTXOutput(10, string(alice.GetAddress()))}
+	assert.False(t, tampered.Verify(prevTXs), "outputs are covered by the signature")
+
+	stolen := tx
+	stolen.Vin = []TXInput{tx.Vin[0]}
+	stolen.Sign(bob.PrivateKey, prevTXs)
+	assert.False(t, stolen.Verify(prevTXs), "only the owner of the public key hash can spend")
+}
+
+func TestScriptMultiSig(t *testing.T) {
+	pubKeys := [][]byte{[]byte("key1"), []byte("key2"), []byte("key3")}
+	script := MultiSigScript(2, pubKeys)
+	sig := func(pubKey []byte) []byte { return append([]byte("sig:"), pubKey...) }
+
+	valid := NewScriptBuilder().AddData(sig(pubKeys[0])).AddData(sig(pubKeys[2])).Script()
+	assert.NoError(t, ExecuteScript(valid, script, fakeChecker{}))
+
+	outOfOrder := NewScriptBuilder().AddData(sig(pubKeys[2])).AddData(sig(pubKeys[0])).Script()
+	assert.ErrorIs(t, ExecuteScript(outOfOrder, script, fakeChecker{}), ErrScriptFailed)
+
+	tooFew := NewScriptBuilder().AddData(sig(pubKeys[1])).Script()
+	assert.ErrorIs(t, ExecuteScript(tooFew, script, fakeChecker{}), ErrScriptFailed)
+}
+
+func TestScriptLockTimeAndData(t *testing.T) {
+	pubKey := []byte("key")
+	unlock := NewScriptBuilder().AddData(append([]byte("sig:"), pubKey...)).AddData(pubKey).Script()
+	lockedUntil := func(lockTime int64) Script {
+		return append(NewScriptBuilder().AddInt(lockTime).AddOp(OP_CHECKLOCKTIMEVERIFY).AddOp(OP_DROP).Script(),
+			PayToPubKeyHashScript(HashPubKey(pubKey))...)
+	}
+	assert.NoError(t, ExecuteScript(unlock, lockedUntil(100), fakeChecker{}))
+	assert.ErrorIs(t, ExecuteScript(unlock, lockedUntil(1000), fakeChecker{}), ErrScriptFailed)
+
+	data := NullDataScript([]byte("hello"))
+	assert.True(t, data.IsUnspendable())
+	assert.Equal(t, "OP_RETURN "+hex.EncodeToString([]byte("hello")), data.String())
+	assert.ErrorIs(t, ExecuteScript(nil, data, fakeChecker{}), ErrScriptFailed)
+
+	notPushOnly := NewScriptBuilder().AddOp(OP_1).AddOp(OP_DUP).Script()
+	assert.ErrorIs(t, ExecuteScript(notPushOnly, NewScriptBuilder().AddOp(OP_1).Script(), fakeChecker{}),
+		ErrScriptFailed)
+}
+
+func TestMultiSigSpend(t *testing.T) {
+	alice, blockChain, set := newTestSet(t)
+	bob := NewWallet()
+	keys := []*Wallet{NewWallet(), NewWallet(), NewWallet()}
+	wallets := Wallets{Wallets: map[string]*Wallet{}, MultiSigs: map[string]Script{}}
+	treasury := wallets.AddMultiSig(2, [][]byte{keys[0].PublicKey, keys[1].PublicKey, keys[2].PublicKey})
+	redeemScript, _ := wallets.GetMultiSig(treasury)
+	assert.True(t, ValidateAddress(treasury))
+	assert.NotEqual(t, alice.GetAddress()[0], treasury[0], "multisig addresses have their own prefix")
+
+	fund := NewUTXOTransaction(alice, treasury, 6, 0, &set)
+	blockChain.MineBlock([]*Transaction{CreateCoinBaseTX(string(alice.GetAddress()), "", 1), fund})
+	treasuryScript, _ := AddressScript(treasury)
+	assert.Len(t, set.FindScriptUTXO(treasuryScript), 1)
+
+	tx := NewMultiSigTransaction(redeemScript, string(bob.GetAddress()), 4, 1, &set)
+	assert.False(t, blockChain.VerifyTransaction(tx))
+
+	assert.Equal(t, 1, blockChain.SignMultiSigTransaction(tx, keys[2].PrivateKey))
+	assert.Equal(t, 0, blockChain.SignMultiSigTransaction(tx, keys[2].PrivateKey), "a key signs only once")
+	assert.Equal(t, 0, blockChain.SignMultiSigTransaction(tx, alice.PrivateKey), "alice is not a key holder")
+	have, need := tx.Vin[0].MultiSigProgress()
+	assert.Equal(t, []int{1, 2}, []int{have, need})
+	assert.False(t, blockChain.VerifyTransaction(tx), "threshold is not met")
+
+	assert.Equal(t, 1, blockChain.SignMultiSigTransaction(tx, keys[0].PrivateKey))
+	assert.True(t, blockChain.VerifyTransaction(tx))
+
+	pool := NewMempool()
+	assert.NoError(t, pool.Add(tx, &set))
+	txs, fees := pool.SelectTransactions(1 << 20)
+	blockChain.MineBlock(append([]*Transaction{CreateCoinBaseTXWithFees(string(alice.GetAddress()), "", 2, fees)}, txs...))
+	assert.Equal(t, 4, balanceOf(set, bob))
+	assert.Equal(t, 1, set.FindScriptUTXO(treasuryScript)[0].Value)
+}
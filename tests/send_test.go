@@ -8,9 +8,11 @@ var (
 	from = "18vhdHeZ2XJLSSd861p4XxFVYwaLeNcGP2"
 	to = "1LKMabNYff5xKot4FRnmMnxSG6C1SHjN96"
 	amount = 1
+	fee = 0
+	lockTime int64 = 0
 	mineNow = true
 )
 
 func TestSend(t *testing.T) {
-	cli.Send(from, to, amount, nodeID, mineNow)
+	cli.Send(from, to, amount, fee, lockTime, nodeID, mineNow)
 }
\ No newline at end of file
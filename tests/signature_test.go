@@ -0,0 +1,55 @@
+package test
+
+import (
+	. "bitcoin_go/src"
+	"crypto/sha256"
+	"encoding/hex"
+	"math/big"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// secp256k1 上 RFC 6979（HMAC-SHA256）的测试向量，消息先做一次 SHA-256，s 已经取了较小的那个
+func TestSignatureVectors(t *testing.T) {
+	vectors := []struct{ key, message, signature string }{
+		{"0000000000000000000000000000000000000000000000000000000000000001", "Satoshi Nakamoto",
+			"934b1ea10a4b3c1757e2b0c017d0b6143ce3c9a7e6a4a49860d7a6ab210ee3d8" +
+				"2442ce9d2b916064108014783e923ec36b49743e2ffa1c4496f01a512aafd9e5"},
+		{"0000000000000000000000000000000000000000000000000000000000000001",
+			"All those moments will be lost in time, like tears in rain. Time to die...",
+			"8600dbd41e348fe5c9465ab92d23e3db8b98b873beecd930736488696438cb6b" +
+				"547fe64427496db33bf66019dacbf0039c04199abb0122918601db38a72cfc21"},
+		{"f8b8af8ce3c7cca5e300d33939540c10d45ce001b8f252bfbc57ba0342904181", "Alan Turing",
+			"7063ae83e7f62bbb171798131b4a0564b956930092b33b07b395615d9ec7e15c" +
+				"58dfcc1e00a35e1572f366ffe34ba0fc47db1e7189759b9fb233c5b05ab388ea"},
+	}
+
+	for _, vector := range vectors {
+		key, _ := hex.DecodeString(vector.key)
+		hash := sha256.Sum256([]byte(vector.message))
+		assert.Equal(t, vector.signature, hex.EncodeToString(NewWalletFromKey(key).Sign(hash[:])), vector.message)
+	}
+}
+
+func TestSignatureLowS(t *testing.T) {
+	alice, blockChain, set := newTestSet(t)
+	bob := NewWallet()
+
+	tx := NewUnsignedTransaction(string(alice.GetAddress()), string(bob.GetAddress()), 3, 0, &set)
+	again := *tx
+	again.Vin = append([]TXInput{}, tx.Vin...)
+	blockChain.SignTransaction(tx, alice.PrivateKey)
+	blockChain.SignTransaction(&again, alice.PrivateKey)
+	assert.Equal(t, tx.Vin[0].ScriptSig, again.Vin[0].ScriptSig, "signatures are deterministic")
+	assert.True(t, blockChain.VerifyTransaction(tx))
+
+	// (r, n-s) 也满足 ECDSA 的等式，但 s 超过 n/2，必须被拒绝
+	n, _ := new(big.Int).SetString("fffffffffffffffffffffffffffffffebaaedce6af48a03bbfd25e8cd0364141", 16)
+	pushes := tx.Vin[0].ScriptSig.PushedData()
+	signature := append([]byte{}, pushes[0]...)
+	s := new(big.Int).SetBytes(signature[32:])
+	new(big.Int).Sub(n, s).FillBytes(signature[32:])
+	tx.Vin[0].ScriptSig = SignatureScript(signature, pushes[1])
+	assert.False(t, blockChain.VerifyTransaction(tx), "high S signatures are malleable")
+}
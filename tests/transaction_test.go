@@ -0,0 +1,117 @@
+package test
+
+import (
+	. "bitcoin_go/src"
+	"crypto/sha256"
+	"encoding/hex"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestIsFinal(t *testing.T) {
+	tx := Transaction{Vin: []TXInput{{Sequence: SequenceFinal}}}
+	assert.True(t, tx.IsFinal(1, 0))
+
+	tx.SetLockTime(5)
+	assert.False(t, tx.IsFinal(5, 0))
+	assert.True(t, tx.IsFinal(6, 0))
+
+	tx.SetLockTime(1600000000)
+	assert.False(t, tx.IsFinal(1000, 1600000000))
+	assert.True(t, tx.IsFinal(0, 1600000001))
+
+	tx.Vin[0].Sequence = SequenceFinal
+	assert.True(t, tx.IsFinal(0, 0), "lock time is ignored when every input is final")
+}
+
+func TestLockTime(t *testing.T) {
+	alice, blockChain, set := newTestSet(t)
+	bob := NewWallet()
+
+	tx := NewUnsignedTransaction(string(alice.GetAddress()), string(bob.GetAddress()), 3, 0, &set)
+	tx.SetLockTime(2)
+	blockChain.SignTransaction(tx, alice.PrivateKey)
+	assert.True(t, blockChain.VerifyTransaction(tx))
+	assert.Error(t, NewMempool().Add(tx, &set), "locked until height 2")
+
+	genesis, _ := blockChain.GetBlockByHeight(0)
+	early := NewBlock([]*Transaction{CreateCoinBaseTX(string(alice.GetAddress()), "", 1), tx}, genesis.Hash, 1, genesis.Bits)
+	assert.ErrorIs(t, blockChain.AddBlock(early), ErrNonFinalTx)
+
+	blockChain.MineBlock([]*Transaction{CreateCoinBaseTX(string(alice.GetAddress()), "", 1)})
+	blockChain.MineBlock([]*Transaction{CreateCoinBaseTX(string(alice.GetAddress()), "", 2)})
+	assert.NoError(t, NewMempool().Add(tx, &set))
+	blockChain.MineBlock([]*Transaction{CreateCoinBaseTX(string(alice.GetAddress()), "", 3), tx})
+	assert.Equal(t, 3, balanceOf(set, bob))
+}
+
+func TestCheckLockTimeVerify(t *testing.T) {
+	alice := NewWallet()
+	vesting := append(NewScriptBuilder().AddInt(100).AddOp(OP_CHECKLOCKTIMEVERIFY).AddOp(OP_DROP).Script(),
+		PayToPubKeyHashScript(HashPubKey(alice.PublicKey))...)
+	prevTx := Transaction{ID: []byte("vesting"), Vout: []TXOutput{{Value: 10, ScriptPubKey: vesting}}}
+	prevTXs := map[string]Transaction{hex.EncodeToString(prevTx.ID): prevTx}
+
+	spend := func(lockTime int64) bool {
+		tx := Transaction{Vin: []TXInput{{Txid: prevTx.ID, Vout: 0, Sequence: SequenceFinal}},
+			Vout: []TXOutput{*NewTXOutput(10, string(alice.GetAddress()))}}
+		tx.SetLockTime(lockTime)
+		tx.Vin[0].ScriptSig = SignatureScript(alice.Sign(tx.SignatureHash(0, vesting)), alice.PublicKey)
+		return tx.Verify(prevTXs)
+	}
+	assert.False(t, spend(99))
+	assert.True(t, spend(100))
+	assert.False(t, spend(1600000000), "height and time lock times are not comparable")
+}
+
+func TestNullData(t *testing.T) {
+	alice, blockChain, set := newTestSet(t)
+
+	data, ok := NullDataScript([]byte("hello")).NullData()
+	assert.True(t, ok)
+	assert.Equal(t, []byte("hello"), data)
+	_, ok = PayToPubKeyHashScript(make([]byte, 20)).NullData()
+	assert.False(t, ok)
+
+	document := sha256.Sum256([]byte("document"))
+	tx := NewNullDataTransaction(string(alice.GetAddress()), document[:], 1, &set)
+	blockChain.SignTransaction(tx, alice.PrivateKey)
+	pool := NewMempool()
+	assert.NoError(t, pool.Add(tx, &set))
+	txs, fees := pool.SelectTransactions(1 << 20)
+	block := blockChain.MineBlock(append([]*Transaction{CreateCoinBaseTXWithFees(string(alice.GetAddress()), "", 1, fees)}, txs...))
+
+	outs, _ := set.FindOutputs(tx.ID)
+	assert.Len(t, outs.Outputs, 1, "only the change is added to the UTXO set")
+	assert.Equal(t, 10-1, outs.Outputs[1].Value)
+	anchor, anchorBlock, err := blockChain.FindNullData(document[:])
+	assert.NoError(t, err)
+	assert.Equal(t, tx.ID, anchor.ID)
+	assert.Equal(t, block.Hash, anchorBlock.Hash)
+	_, _, err = blockChain.FindNullData([]byte("missing"))
+	assert.Error(t, err)
+
+	large := NewNullDataTransaction(string(alice.GetAddress()), []byte("data"), 0, &set)
+	large.Vout[0].ScriptPubKey = NullDataScript(make([]byte, MaxNullDataSize+1))
+	large.SetID()
+	blockChain.SignTransaction(large, alice.PrivateKey)
+	assert.Error(t, NewMempool().Add(large, &set))
+	tip, _ := blockChain.GetBlockByHeight(1)
+	oversized := NewBlock([]*Transaction{CreateCoinBaseTX(string(alice.GetAddress()), "", 2), large}, tip.Hash, 2, tip.Bits)
+	assert.ErrorIs(t, blockChain.AddBlock(oversized), ErrBadNullData)
+
+	// 同一个块里锚定了两次，取排在前面的那笔
+	bob := NewWallet()
+	blockChain.MineBlock([]*Transaction{CreateCoinBaseTX(string(bob.GetAddress()), "", 2)})
+	twice := sha256.Sum256([]byte("twice"))
+	first := NewNullDataTransaction(string(bob.GetAddress()), twice[:], 0, &set)
+	blockChain.SignTransaction(first, bob.PrivateKey)
+	second := NewNullDataTransaction(string(alice.GetAddress()), twice[:], 0, &set)
+	blockChain.SignTransaction(second, alice.PrivateKey)
+	block = blockChain.MineBlock([]*Transaction{CreateCoinBaseTX(string(alice.GetAddress()), "", 3), first, second})
+	anchor, anchorBlock, err = blockChain.FindNullData(twice[:])
+	assert.NoError(t, err)
+	assert.Equal(t, first.ID, anchor.ID)
+	assert.Equal(t, block.Hash, anchorBlock.Hash)
+}
@@ -1,6 +1,11 @@
 package test
 
-import "testing"
+import (
+	. "bitcoin_go/src"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
 
 func TestGetBalance(t *testing.T) {
 	cli.GetBalance(address, nodeID)
@@ -8,4 +13,96 @@ func TestGetBalance(t *testing.T) {
 
 func TestReindexUTXO(t *testing.T) {
 	cli.ReindexUTXO(nodeID)
-}
\ No newline at end of file
+}
+func balanceOf(set UTXOSet, wallet *Wallet) int {
+	balance := 0
+	for _, out := range set.FindUTXO(HashPubKey(wallet.PublicKey)) {
+		balance += out.Value
+	}
+
+	return balance
+}
+
+func TestUTXOSetUpdateAndRevert(t *testing.T) {
+	sender, blockChain, set := newTestSet(t)
+	receiver := NewWallet()
+
+	// MineBlock 已经更新了 UTXO 集
+	tx := NewUTXOTransaction(sender, string(receiver.GetAddress()), 3, 0, &set)
+	block := blockChain.MineBlock([]*Transaction{CreateCoinBaseTX(string(receiver.GetAddress()), "", 1), tx})
+	assert.Equal(t, 7, balanceOf(set, sender))
+	assert.Equal(t, 13, balanceOf(set, receiver))
+
+	set.Revert(block)
+	assert.Equal(t, 10, balanceOf(set, sender))
+	assert.Equal(t, 0, balanceOf(set, receiver))
+	assert.Equal(t, 1, set.CountTransactions())
+	genesisOutputs, _ := set.FindOutputs(tx.Vin[0].Txid)
+	assert.True(t, genesisOutputs.CoinBase, "restored outputs keep their height and kind")
+
+	set.Update(block)
+	assert.Equal(t, 7, balanceOf(set, sender))
+	assert.Equal(t, 13, balanceOf(set, receiver))
+	assert.Equal(t, 2, set.CountTransactions())
+}
+
+// 块只通过入链和重组连接到 chainstate 或从中撤销，撤销时恢复被花掉的输出
+func TestUTXOSetConnectAndDisconnect(t *testing.T) {
+	sender, blockChain, set := newTestSet(t)
+	receiver := NewWallet()
+	miner := NewWallet()
+	assert.Equal(t, 10, balanceOf(set, sender))
+	genesis, _ := blockChain.GetBlockByHeight(0)
+
+	tx := NewUTXOTransaction(sender, string(receiver.GetAddress()), 3, 0, &set)
+	block := blockChain.MineBlock([]*Transaction{CreateCoinBaseTX(string(receiver.GetAddress()), "", 1), tx})
+	assert.Equal(t, 7, balanceOf(set, sender))
+	assert.Equal(t, 13, balanceOf(set, receiver))
+	assert.Equal(t, 2, set.CountTransactions(), "genesis coinbase is fully spent")
+
+	// 更重的分支上没有这个块，它被撤销
+	fork1 := NewBlock([]*Transaction{CreateCoinBaseTX(string(miner.GetAddress()), "", 1)}, genesis.Hash, 1, genesis.Bits)
+	assert.NoError(t, blockChain.AddBlock(fork1))
+	fork2 := NewBlock([]*Transaction{CreateCoinBaseTX(string(miner.GetAddress()), "", 2)}, fork1.Hash, 2, fork1.Bits)
+	assert.NoError(t, blockChain.AddBlock(fork2))
+	assert.Equal(t, 10, balanceOf(set, sender))
+	assert.Equal(t, 0, balanceOf(set, receiver))
+	assert.Equal(t, 3, set.CountTransactions())
+	genesisOutputs, _ := set.FindOutputs(tx.Vin[0].Txid)
+	assert.True(t, genesisOutputs.CoinBase, "restored outputs keep their height and kind")
+	assert.Equal(t, 0, genesisOutputs.Height)
+
+	// 原来的分支又变重了，块重新连接
+	block2 := NewBlock([]*Transaction{CreateCoinBaseTX(string(miner.GetAddress()), "", 2)}, block.Hash, 2, block.Bits)
+	assert.NoError(t, blockChain.AddBlock(block2))
+	block3 := NewBlock([]*Transaction{CreateCoinBaseTX(string(miner.GetAddress()), "", 3)}, block2.Hash, 3, block2.Bits)
+	assert.NoError(t, blockChain.AddBlock(block3))
+	assert.Equal(t, 7, balanceOf(set, sender))
+	assert.Equal(t, 13, balanceOf(set, receiver))
+	assert.Equal(t, 20, balanceOf(set, miner))
+}
+
+func TestCoinbaseMaturity(t *testing.T) {
+	miner, blockChain, set := newTestSet(t)
+	receiver := NewWallet()
+	params := *ActiveChainParams()
+	params.CoinbaseMaturity = 3
+
+	blockChain.MineBlock([]*Transaction{CreateCoinBaseTX(string(receiver.GetAddress()), "", 1)})
+
+	tx := NewUTXOTransaction(miner, string(receiver.GetAddress()), 3, 0, &set)
+	SetChainParams(&params)
+
+	// 创世块的奖励到第 3 个块才成熟
+	assert.Panics(t, func() { NewUTXOTransaction(miner, string(receiver.GetAddress()), 3, 0, &set) },
+		"immature coinbase output is not selected")
+	assert.Error(t, NewMempool().Add(tx, &set))
+	tip, _ := blockChain.GetBlockByHeight(1)
+	early := NewBlock([]*Transaction{CreateCoinBaseTX(string(receiver.GetAddress()), "", 2), tx}, tip.Hash, 2, tip.Bits)
+	assert.ErrorIs(t, blockChain.AddBlock(early), ErrImmatureSpend)
+
+	blockChain.MineBlock([]*Transaction{CreateCoinBaseTX(string(receiver.GetAddress()), "", 2)})
+	assert.NoError(t, NewMempool().Add(tx, &set))
+	blockChain.MineBlock([]*Transaction{CreateCoinBaseTX(string(receiver.GetAddress()), "", 3), tx})
+	assert.Equal(t, 7, balanceOf(set, miner))
+}
@@ -0,0 +1,99 @@
+package test
+
+import (
+	. "bitcoin_go/src"
+	"math"
+	"math/big"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestValidateBlock(t *testing.T) {
+	miner, blockChain, set := newTestSet(t)
+	receiver := NewWallet()
+	minerAddress := string(miner.GetAddress())
+	genesis, _ := blockChain.GetBlockByHeight(0)
+
+	tampered := genesis
+	tampered.Nonce++
+	assert.ErrorIs(t, blockChain.AddBlock(&tampered), ErrBadProofOfWork)
+
+	easy := NewBlock([]*Transaction{CreateCoinBaseTX(minerAddress, "", 1)}, genesis.Hash, 1,
+		BigToCompact(new(big.Int).Lsh(big.NewInt(1), 240)))
+	assert.ErrorIs(t, blockChain.AddBlock(easy), ErrBadDifficulty)
+
+	tx := NewUTXOTransaction(miner, string(receiver.GetAddress()), 3, 0, &set)
+
+	doubleSpend := NewBlock([]*Transaction{CreateCoinBaseTX(minerAddress, "", 1), tx, tx}, genesis.Hash, 1, genesis.Bits)
+	assert.ErrorIs(t, blockChain.ValidateBlock(doubleSpend), ErrDoubleSpend)
+
+	noCoinBase := NewBlock([]*Transaction{tx}, genesis.Hash, 1, genesis.Bits)
+	assert.ErrorIs(t, blockChain.AddBlock(noCoinBase), ErrBadCoinBase)
+
+	greedy := CreateCoinBaseTX(minerAddress, "", 1)
+	greedy.Vout[0].Value++
+	greedy.SetID()
+	overpaid := NewBlock([]*Transaction{greedy, tx}, genesis.Hash, 1, genesis.Bits)
+	err := blockChain.AddBlock(overpaid)
+	assert.ErrorIs(t, err, ErrBadCoinBaseVal)
+	assert.IsType(t, &BlockError{}, err)
+	assert.False(t, blockChain.HasBlock(overpaid.Hash), "invalid block is not stored")
+
+	valid := NewBlock([]*Transaction{CreateCoinBaseTX(minerAddress, "", 1), tx}, genesis.Hash, 1, genesis.Bits)
+	stripped := *valid
+	stripped.Transcations = valid.Transcations[:1]
+	assert.ErrorIs(t, blockChain.ValidateBlock(&stripped), ErrBadMerkleRoot)
+	assert.NoError(t, blockChain.ValidateBlock(valid))
+	assert.NoError(t, blockChain.AddBlock(valid))
+	assert.Equal(t, 1, blockChain.GetBestHeight())
+
+	// 引用不存在的交易的输入只是校验不通过，不会 panic
+	unknown := *tx
+	unknown.Vin = append([]TXInput{}, tx.Vin...)
+	unknown.Vin[0].Txid = make([]byte, 32)
+	assert.False(t, blockChain.VerifyTransaction(&unknown))
+}
+
+func TestValidateValues(t *testing.T) {
+	miner, blockChain, set := newTestSet(t)
+	receiver := NewWallet()
+	minerAddress := string(miner.GetAddress())
+	genesis, _ := blockChain.GetBlockByHeight(0)
+	coinBase := func() *Transaction { return CreateCoinBaseTX(minerAddress, "", 1) }
+	// 改了输出的交易重新计算 ID 再签名
+	resign := func(tx *Transaction) {
+		for i := range tx.Vin {
+			tx.Vin[i].ScriptSig = nil
+		}
+		tx.SetID()
+		blockChain.SignTransaction(tx, miner.PrivateKey)
+	}
+
+	// 两个输出加起来溢出成负数，不能因此通过“输出不超过输入”的检查
+	overflow := NewUTXOTransaction(miner, string(receiver.GetAddress()), 3, 0, &set)
+	overflow.Vout[0].Value, overflow.Vout[1].Value = math.MaxInt64, math.MaxInt64
+	resign(overflow)
+	assert.ErrorIs(t, NewMempool().Add(overflow, &set), ErrBadValue)
+	block := NewBlock([]*Transaction{coinBase(), overflow}, genesis.Hash, 1, genesis.Bits)
+	assert.ErrorIs(t, blockChain.AddBlock(block), ErrBadValue)
+
+	negative := NewUTXOTransaction(miner, string(receiver.GetAddress()), 3, 0, &set)
+	negative.Vout[0].Value = -1
+	resign(negative)
+	assert.ErrorIs(t, NewMempool().Add(negative, &set), ErrBadValue)
+
+	inflated := coinBase()
+	inflated.Vout = append(inflated.Vout, inflated.Vout[0], inflated.Vout[0])
+	inflated.Vout[1].Value, inflated.Vout[2].Value = math.MaxInt64, math.MaxInt64
+	inflated.SetID()
+	block = NewBlock([]*Transaction{inflated}, genesis.Hash, 1, genesis.Bits)
+	assert.ErrorIs(t, blockChain.AddBlock(block), ErrBadValue)
+
+	noInputs := &Transaction{Vout: []TXOutput{*NewTXOutput(1, minerAddress)}}
+	noInputs.SetID()
+	assert.ErrorIs(t, NewMempool().Add(noInputs, &set), ErrNoInputs)
+	block = NewBlock([]*Transaction{coinBase(), noInputs}, genesis.Hash, 1, genesis.Bits)
+	assert.ErrorIs(t, blockChain.AddBlock(block), ErrNoInputs)
+	assert.Equal(t, 0, blockChain.GetBestHeight())
+}
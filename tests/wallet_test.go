@@ -2,8 +2,16 @@ package test
 
 import (
     . "bitcoin_go/src"
+    "bytes"
+    "crypto/ecdsa"
+    "crypto/elliptic"
+    "crypto/rand"
+    "encoding/gob"
     "encoding/hex"
     "fmt"
+    "io/ioutil"
+    "os"
+    "path/filepath"
 	"testing"
 
     // third package
@@ -30,3 +38,270 @@ func TestGetAddress(t *testing.T) {
 func TestListAddress(t *testing.T) {
 	cli.ListAddresses(nodeID)
 }
+
+func TestAddressNetwork(t *testing.T) {
+	wallet := NewWallet()
+	mainAddress := string(wallet.GetAddress())
+	assert.True(t, ValidateAddress(mainAddress))
+
+	useRegTest(t)
+	regTestAddress := string(wallet.GetAddress())
+	assert.Equal(t, byte('R'), regTestAddress[0])
+	assert.True(t, ValidateAddress(regTestAddress))
+	assert.False(t, ValidateAddress(mainAddress), "address of another network is rejected")
+
+	params, err := ChainParamsByName("testnet")
+	assert.NoError(t, err)
+	assert.Equal(t, &TestNetParams, params)
+	_, err = ChainParamsByName("unknown")
+	assert.Error(t, err)
+}
+
+func TestWalletFileEncrypted(t *testing.T) {
+	useRegTest(t)
+	walletFile := fmt.Sprintf(ActiveChainParams().WalletFile, "encrypted")
+
+	wallets, err := NewWallets("encrypted", []byte("correct horse"))
+	assert.True(t, os.IsNotExist(err))
+	assert.NoError(t, wallets.SetMnemonic(NewMnemonic()))
+	address := wallets.CreateWallet()
+	wallets.AddMultiSig(1, [][]byte{wallets.GetWallet(address).PublicKey})
+	wallets.SaveToFile("encrypted")
+
+	info, err := os.Stat(walletFile)
+	assert.NoError(t, err)
+	assert.Equal(t, os.FileMode(0600), info.Mode().Perm())
+	content, _ := ioutil.ReadFile(walletFile)
+	assert.True(t, IsEncryptedWalletFile(content))
+	key := wallets.GetWallet(address).PrivateKey.D.Bytes()
+	assert.False(t, bytes.Contains(content, key), "the private key is not stored in plaintext")
+	assert.False(t, bytes.Contains(content, []byte(address)))
+
+	_, err = NewWallets("encrypted", []byte("wrong"))
+	assert.ErrorIs(t, err, ErrWrongPassphrase)
+	loaded, err := NewWallets("encrypted", []byte("correct horse"))
+	assert.NoError(t, err)
+	assert.Equal(t, wallets.GetWallet(address).PublicKey, loaded.GetWallet(address).PublicKey)
+	assert.Equal(t, key, loaded.GetWallet(address).PrivateKey.D.Bytes())
+	assert.Len(t, loaded.MultiSigs, 1)
+
+	loaded.ChangePassphrase([]byte("battery staple"))
+	loaded.SaveToFile("encrypted")
+	_, err = NewWallets("encrypted", []byte("correct horse"))
+	assert.ErrorIs(t, err, ErrWrongPassphrase)
+	_, err = NewWallets("encrypted", []byte("battery staple"))
+	assert.NoError(t, err)
+}
+
+func TestWalletFileScryptParams(t *testing.T) {
+	useRegTest(t)
+	walletFile := fmt.Sprintf(ActiveChainParams().WalletFile, "scrypt")
+
+	wallets, _ := NewWallets("scrypt", []byte("passphrase"))
+	assert.NoError(t, wallets.SetMnemonic(NewMnemonic()))
+	wallets.SaveToFile("scrypt")
+	content, _ := ioutil.ReadFile(walletFile)
+	magic := len("BTCGOWALLET")
+
+	// 和 src 里 encryptedWallet 的字段一样，gob 按字段名解码
+	var file struct {
+		Version    int
+		Salt       []byte
+		N, R, P    int
+		Nonce      []byte
+		Ciphertext []byte
+	}
+	assert.NoError(t, gob.NewDecoder(bytes.NewReader(content[magic:])).Decode(&file))
+	tamper := func(n, r, p int) error {
+		file.N, file.R, file.P = n, r, p
+		tampered := bytes.NewBuffer(append([]byte{}, content[:magic]...))
+		assert.NoError(t, gob.NewEncoder(tampered).Encode(file))
+		assert.NoError(t, ioutil.WriteFile(walletFile, tampered.Bytes(), 0600))
+		_, err := NewWallets("scrypt", []byte("passphrase"))
+		return err
+	}
+	// 参数在认证之前就用，太大的值不能拿去派生密钥
+	for _, params := range [][3]int{{1 << 30, 8, 1}, {1 << 15, 1 << 20, 1}, {1 << 15, 8, 1 << 20}, {0, 8, 1}, {1 << 15, 8, 0}} {
+		err := tamper(params[0], params[1], params[2])
+		assert.Error(t, err)
+		assert.NotErrorIs(t, err, ErrWrongPassphrase)
+	}
+	assert.ErrorIs(t, tamper(1<<14, 8, 1), ErrWrongPassphrase, "the header is authenticated")
+	assert.NoError(t, tamper(1<<15, 8, 1))
+}
+
+func TestPlaintextWalletFile(t *testing.T) {
+	useRegTest(t)
+
+	// 旧版本写的明文钱包：两个 P-256 密钥，gob 编码的 ecdsa.PrivateKey 里带着当时的 Curve 类型，地址是主网的
+	content, err := ioutil.ReadFile(filepath.Join(testData, "wallet_plaintext.dat"))
+	assert.NoError(t, err)
+	assert.False(t, IsEncryptedWalletFile(content))
+	assert.NoError(t, ioutil.WriteFile(fmt.Sprintf(ActiveChainParams().WalletFile, "plaintext"), content, 0600))
+
+	wallets, err := NewWallets("plaintext", nil)
+	assert.NoError(t, err)
+	assert.False(t, wallets.HasPassphrase())
+	addresses := []string{"1AffjtQuMuX5KEaBWCER32mJ1e8owFTDoG", "1HDC7ABS2vdBNB82xyACnups894UWUfShQ"}
+	assert.ElementsMatch(t, addresses, wallets.GetAddresses())
+
+	for _, address := range addresses {
+		wallet := wallets.GetWallet(address)
+		assert.Equal(t, Base58Decode([]byte(address))[1:21], HashPubKey(wallet.PublicKey))
+
+		prevTx := CreateCoinBaseTX(string(wallet.GetAddress()), "", 0)
+		tx := Transaction{Vin: []TXInput{{Txid: prevTx.ID, Vout: 0, Sequence: SequenceFinal}},
+			Vout: []TXOutput{*NewTXOutput(10, string(NewWallet().GetAddress()))}}
+		tx.SetID()
+		prevTXs := map[string]Transaction{hex.EncodeToString(prevTx.ID): *prevTx}
+		tx.Sign(wallet.PrivateKey, prevTXs)
+		assert.True(t, tx.Verify(prevTXs), "keys of the plaintext wallet can still spend")
+	}
+
+	// 设置口令后保存为加密文件，密钥不变
+	wallets.ChangePassphrase([]byte("passphrase"))
+	wallets.SaveToFile("plaintext")
+	loaded, err := NewWallets("plaintext", []byte("passphrase"))
+	assert.NoError(t, err)
+	for _, address := range addresses {
+		assert.Equal(t, wallets.GetWallet(address).PrivateKey.D, loaded.GetWallet(address).PrivateKey.D)
+	}
+}
+
+func TestHDWallet(t *testing.T) {
+	useRegTest(t)
+	mnemonic := "legal winner thank year wave sausage worth useful legal winner thank yellow"
+
+	wallets, _ := NewWallets("hd", []byte("passphrase"))
+	assert.Panics(t, func() { wallets.CreateWallet() }, "addresses are derived from a seed")
+	assert.ErrorIs(t, wallets.SetMnemonic("legal winner thank year wave sausage worth useful legal winner thank thank"),
+		ErrBadMnemonic)
+	assert.NoError(t, wallets.SetMnemonic(mnemonic))
+	assert.Error(t, wallets.SetMnemonic(mnemonic), "the seed cannot be replaced")
+	var addresses []string
+	for i := 0; i < 4; i++ {
+		addresses = append(addresses, wallets.CreateWallet())
+	}
+	assert.NotEqual(t, addresses[0], addresses[1])
+	wallets.SaveToFile("hd")
+
+	loaded, err := NewWallets("hd", []byte("passphrase"))
+	assert.NoError(t, err)
+	assert.ElementsMatch(t, addresses, loaded.GetAddresses())
+	assert.Equal(t, wallets.GetWallet(addresses[2]).PrivateKey.D, loaded.GetWallet(addresses[2]).PrivateKey.D)
+
+	// 只有第 0 和第 3 个地址在链上收过钱，恢复时前 4 个地址都要找回来
+	blockChain := newTestChain(t, addresses[0])
+	blockChain.MineBlock([]*Transaction{CreateCoinBaseTX(addresses[3], "", 1)})
+	used := blockChain.UsedPubKeyHashes()
+
+	restored, _ := NewWallets("restored", []byte("passphrase"))
+	assert.NoError(t, restored.SetMnemonic(" LEGAL winner thank year wave sausage worth useful legal winner thank yellow "))
+	assert.Equal(t, 4, restored.Restore(func(pubKeyHash []byte) bool { return used[hex.EncodeToString(pubKeyHash)] }))
+	assert.ElementsMatch(t, addresses, restored.GetAddresses())
+	assert.Equal(t, 0, restored.Restore(func([]byte) bool { return false }))
+	assert.NotContains(t, addresses, restored.CreateWallet(), "the next address follows the restored ones")
+}
+
+func TestSecp256k1Wallet(t *testing.T) {
+	wallet := NewWallet()
+	assert.Len(t, wallet.PublicKey, 33)
+	assert.Contains(t, []byte{2, 3}, wallet.PublicKey[0])
+
+	// BIP44 的常用测试助记词，第一个地址 m/44'/0'/0'/0/0 与其他钱包软件一致
+	wallets := Wallets{Wallets: map[string]*Wallet{}, MultiSigs: map[string]Script{}}
+	assert.NoError(t, wallets.SetMnemonic("abandon abandon abandon abandon abandon abandon abandon abandon abandon "+
+		"abandon abandon about"))
+	address := wallets.CreateWallet()
+	assert.Equal(t, "1LqBGSKuX5yYUonjxT5qGfpUsXKYYWeabA", address)
+	assert.Equal(t, "03aaeb52dd7494c361049de67cc680e83ebcbbbdbeb13637d92cd845f70308af5e",
+		hex.EncodeToString(wallets.GetWallet(address).PublicKey))
+}
+
+// 旧版本的 P-256 密钥：公钥是 X 和 Y 直接拼接，X 开头是 0 字节时只有 63 字节
+func legacyWallet() *Wallet {
+	for {
+		private, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		if private.X.BitLen() <= 248 && private.Y.BitLen() > 248 {
+			return &Wallet{PrivateKey: *private, PublicKey: append(private.X.Bytes(), private.Y.Bytes()...)}
+		}
+	}
+}
+
+func TestLegacyP256Wallet(t *testing.T) {
+	useRegTest(t)
+
+	legacy := legacyWallet()
+	assert.Len(t, legacy.PublicKey, 63)
+	address := string(legacy.GetAddress())
+
+	prevTx := CreateCoinBaseTX(address, "", 0)
+	tx := Transaction{Vin: []TXInput{{Txid: prevTx.ID, Vout: 0, Sequence: SequenceFinal}},
+		Vout: []TXOutput{*NewTXOutput(10, string(NewWallet().GetAddress()))}}
+	tx.SetID()
+	prevTXs := map[string]Transaction{hex.EncodeToString(prevTx.ID): *prevTx}
+	tx.Sign(legacy.PrivateKey, prevTXs)
+	assert.Len(t, tx.Vin[0].ScriptSig.PushedData()[0], 64, "signatures have a fixed width")
+	assert.True(t, tx.Verify(prevTXs), "outputs of P-256 keys stay spendable")
+
+	wallets, _ := NewWallets("legacy", []byte("passphrase"))
+	wallets.Wallets[address] = legacy
+	wallets.SaveToFile("legacy")
+	loaded, err := NewWallets("legacy", []byte("passphrase"))
+	assert.NoError(t, err)
+	assert.Equal(t, legacy.PublicKey, loaded.GetWallet(address).PublicKey)
+	assert.Equal(t, legacy.PrivateKey.D, loaded.GetWallet(address).PrivateKey.D)
+}
+
+func TestWIF(t *testing.T) {
+	key, _ := hex.DecodeString("0c28fca386c7a227600b2fe50b7cae11ec86d3bf1fbe471be89827e19d72aa1d")
+	assert.Equal(t, "KwdMAjGmerYanjeui5SHS7JkmpZvVipYvB2LJGU1ZxJwYvP98617", EncodeWIF(key))
+	decoded, err := DecodeWIF("KwdMAjGmerYanjeui5SHS7JkmpZvVipYvB2LJGU1ZxJwYvP98617")
+	assert.NoError(t, err)
+	assert.Equal(t, key, decoded)
+
+	_, err = DecodeWIF("5HueCGU8rMjxEXxiPuD5BDku4MkFqeZyd4dZ1jvhTVqvbTLvyTJ")
+	assert.ErrorIs(t, err, ErrBadWIF, "keys of uncompressed public keys")
+	_, err = DecodeWIF("KwdMAjGmerYanjeui5SHS7JkmpZvVipYvB2LJGU1ZxJwYvP98618")
+	assert.ErrorIs(t, err, ErrBadWIF, "wrong checksum")
+	_, err = DecodeWIF("KwdMAjGmerYanjeui5SHS7JkmpZvVipYvB2LJGU1ZxJwYvP9861O")
+	assert.ErrorIs(t, err, ErrBadWIF, "not a Base58 character")
+
+	// 其他钱包软件导出的同一个密钥：BIP44 测试助记词的第一个地址
+	wallets := Wallets{Wallets: map[string]*Wallet{}, MultiSigs: map[string]Script{}}
+	address, err := wallets.ImportKey("L4p2b9VAf8k5aUahF1JCJUzZkgNEAqLfq8DDdQiyAprQAKSbu8hf")
+	assert.NoError(t, err)
+	assert.Equal(t, "1LqBGSKuX5yYUonjxT5qGfpUsXKYYWeabA", address)
+}
+
+func TestImportKey(t *testing.T) {
+	useRegTest(t)
+
+	source := Wallets{Wallets: map[string]*Wallet{}, MultiSigs: map[string]Script{}}
+	assert.NoError(t, source.SetMnemonic(NewMnemonic()))
+	address := source.CreateWallet()
+	wif, err := source.ExportKey(address)
+	assert.NoError(t, err)
+	assert.Equal(t, byte('c'), wif[0], "testnet and regtest keys start with c")
+	_, err = source.ExportKey("missing")
+	assert.Error(t, err)
+
+	wallets, _ := NewWallets("import", []byte("test"))
+	imported, err := wallets.ImportKey(wif)
+	assert.NoError(t, err)
+	assert.Equal(t, address, imported)
+	wallets.SaveToFile("import")
+
+	wallets, err = NewWallets("import", []byte("test"))
+	assert.NoError(t, err)
+	assert.Equal(t, source.GetWallet(address).PublicKey, wallets.GetWallet(address).PublicKey,
+		"imported keys are saved without a seed")
+
+	_, err = wallets.ImportKey("KwdMAjGmerYanjeui5SHS7JkmpZvVipYvB2LJGU1ZxJwYvP98617")
+	assert.ErrorIs(t, err, ErrBadWIF, "mainnet keys are rejected on regtest")
+
+	legacy := legacyWallet()
+	wallets.Wallets["legacy"] = legacy
+	_, err = wallets.ExportKey("legacy")
+	assert.Error(t, err, "P-256 keys have no WIF")
+}